@@ -0,0 +1,55 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// audienceValidatingAuthenticator rejects bearer tokens whose aud claim does
+// not intersect the configured audiences, before the token reaches the
+// delegate. Tokens without an aud claim (legacy, unscoped service account
+// tokens) and requests without a bearer token pass through unchanged; the
+// delegate remains responsible for validating the credential itself.
+type audienceValidatingAuthenticator struct {
+	delegate  authenticator.Request
+	audiences []string
+}
+
+func (a *audienceValidatingAuthenticator) AuthenticateRequest(req *http.Request) (user.Info, bool, error) {
+	if tokenAuds, ok := tokenAudiences(bearerToken(req)); ok {
+		if !audiencesIntersect(tokenAuds, a.audiences) {
+			return nil, false, fmt.Errorf("token audiences %v do not include any of the configured audiences", tokenAuds)
+		}
+	}
+	return a.delegate.AuthenticateRequest(req)
+}
+
+func audiencesIntersect(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
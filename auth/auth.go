@@ -17,38 +17,376 @@ limitations under the License.
 package auth
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/brancz/kube-rbac-proxy/metrics"
 
+	authenticationapi "k8s.io/api/authentication/v1beta1"
+	authorizationapi "k8s.io/api/authorization/v1beta1"
 	"k8s.io/apiserver/pkg/authentication/authenticator"
 	"k8s.io/apiserver/pkg/authentication/authenticatorfactory"
+	"k8s.io/apiserver/pkg/authentication/group"
+	unionauth "k8s.io/apiserver/pkg/authentication/request/union"
 	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/apiserver/pkg/authorization/authorizer"
 	"k8s.io/apiserver/pkg/authorization/authorizerfactory"
 	clientset "k8s.io/client-go/kubernetes"
 	authenticationclient "k8s.io/client-go/kubernetes/typed/authentication/v1beta1"
 	authorizationclient "k8s.io/client-go/kubernetes/typed/authorization/v1beta1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/flowcontrol"
 )
 
 type X509Config struct {
 	ClientCAFile string
+	// When true, presented client certificates must declare the clientAuth
+	// extended key usage and a compatible key usage to be accepted.
+	EnforceKeyUsage bool
+	// ExtraFields lists client certificate fields ("serial", "san-uri",
+	// "organization") that are copied into the user's extra, and with it into
+	// the SubjectAccessReview, so authorizers can decide based on certificate
+	// metadata.
+	ExtraFields []string
+	// MinRSAKeySize, when positive, rejects client certificates whose RSA
+	// public key is shorter than the given number of bits, even when the
+	// certificate chains to a trusted CA. It enforces cryptographic policy
+	// on client credentials the proxy does not issue itself.
+	MinRSAKeySize int
+	// RejectWeakSignatureAlgorithms, when true, rejects client certificates
+	// signed with deprecated algorithms (MD5, SHA-1), even when the
+	// certificate chains to a trusted CA.
+	RejectWeakSignatureAlgorithms bool
+	// ReloadInterval, when positive, is how often the client CA bundle file
+	// is checked for changes and reloaded, so certificates signed by a
+	// rotated CA are accepted without restarting the proxy. Zero disables
+	// reloading; the bundle is then read once at startup.
+	ReloadInterval time.Duration
 }
 
+// BackendRateLimitConfig caps the global rate of authentication and
+// authorization backend calls.
+type BackendRateLimitConfig struct {
+	// QPS is the maximum sustained rate of requests reaching the backends,
+	// shared across all clients.
+	QPS float32 `json:"qps,omitempty"`
+	// Burst is the allowance on top of QPS.
+	Burst int `json:"burst,omitempty"`
+}
+
+// CORSConfig lists what a CORS preflight answered by the proxy may allow.
+type CORSConfig struct {
+	// AllowedOrigins are the origins whose preflights are answered; "*"
+	// matches any origin. Preflights from other origins fall through to
+	// regular handling (and fail auth, as before).
+	AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+	// AllowedMethods is the Access-Control-Allow-Methods value, e.g.
+	// "GET", "POST".
+	AllowedMethods []string `json:"allowedMethods,omitempty"`
+	// AllowedHeaders is the Access-Control-Allow-Headers value, e.g.
+	// "Authorization".
+	AllowedHeaders []string `json:"allowedHeaders,omitempty"`
+}
+
+// OriginAllowed reports whether a preflight from the given origin may be
+// answered by the proxy.
+func (c *CORSConfig) OriginAllowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrorBodyConfig controls what the client sees on authentication and
+// authorization failures.
+type ErrorBodyConfig struct {
+	// Mode is "text" (the default: the plain status text) or "json" (a
+	// structured body {"error": ..., "status": ...} with an
+	// application/json content type), for API clients that parse errors.
+	Mode string `json:"mode,omitempty"`
+	// Overrides maps a status code ("401", "403", "500") to a fixed
+	// response body, taking precedence over Mode for that status.
+	Overrides map[string]string `json:"overrides,omitempty"`
+}
+
+// The supported values for ErrorBodyConfig.Mode.
+const (
+	ErrorBodyText = "text"
+	ErrorBodyJSON = "json"
+)
+
 type AuthnConfig struct {
-	X509   *X509Config
-	Header *AuthnHeaderConfig
+	X509          *X509Config
+	Header        *AuthnHeaderConfig
+	TrustedHeader *TrustedHeaderConfig
+	// CacheTTL is how long successful token authentication results are
+	// cached, trading load on the API server's TokenReview endpoint against
+	// revocation delay. Defaults to 2 minutes when zero; negative values are
+	// rejected.
+	CacheTTL time.Duration
+	// FailureCacheTTL is the length of time an authentication failure for a
+	// given token is remembered, short-circuiting repeated validation of
+	// known-bad credentials. Zero disables the negative cache. Transient
+	// backend errors are never cached.
+	FailureCacheTTL time.Duration
+	// NoCachePaths lists request paths (exact values or prefixes ending in
+	// '*') for which authentication results are never served from the cache,
+	// so sensitive endpoints revalidate credentials on every request.
+	NoCachePaths []string
+	// AnonymousPaths lists request paths (exact values or prefixes ending in
+	// '*') for which an identity resolving to the anonymous user is
+	// tolerated. Everywhere else any authenticator yielding system:anonymous
+	// (or the system:unauthenticated group) is rejected, keeping "no
+	// anonymous" semantics consistent across all configured authenticators.
+	AnonymousPaths []string
+	// StaticGroups are appended to the groups of every authenticated user
+	// before authorization and header injection, e.g. to funnel all proxy
+	// clients through one RBAC group.
+	StaticGroups []string
+	// CNGroups maps an authenticated user name (under x509 authentication,
+	// the certificate common name) to an additional group. It allows group
+	// membership decisions at the proxy for certificates whose Organization
+	// fields cannot be reissued.
+	CNGroups map[string]string
+	// Audiences restricts token authentication to tokens scoped to at least
+	// one of the listed audiences. Empty means no audience check, keeping
+	// legacy (unscoped) service account tokens working.
+	Audiences []string
+	// PassthroughToken, when true, forwards the client's Authorization
+	// header to the upstream only when the request authenticated with a
+	// bearer token, so the upstream can make its own API calls on the user's
+	// behalf. Requests that presented a client certificate have the header
+	// stripped instead: the authentication result cannot be attributed to
+	// the token in that case. When false, the header passes through
+	// untouched (subject to per-path authorizationHeaderPolicy rules). It
+	// coexists with header-based identity injection.
+	PassthroughToken bool
+	// Challenge is the WWW-Authenticate value sent with 401 responses, so
+	// clients know how to authenticate. It may carry scheme parameters, e.g.
+	// `Bearer realm="metrics"`. Defaults to "Bearer" when empty.
+	Challenge string
+	// CapCacheAtTokenExpiry, when true, never serves a cached authentication
+	// result past the presenting token's own expiry: tokens whose expiry has
+	// passed are revalidated against the backend even while a cache entry is
+	// still live. Forced revalidations are counted in metrics so operators
+	// can judge cache effectiveness with short-lived tokens.
+	CapCacheAtTokenExpiry bool
 }
 
 type AuthzConfig struct {
-	ResourceAttributes *ResourceAttributes
+	Rewrites           *SubjectAccessReviewRewrites `json:"rewrites,omitempty"`
+	ResourceAttributes *ResourceAttributes          `json:"resourceAttributes,omitempty"`
+	// BaseResourceAttributes, when set together with Rewrites, is a static
+	// attribute record checked in addition to the rewritten ones; its fields
+	// are taken verbatim, without templating. This gives defense in depth: the
+	// per-value check and the base capability check must both pass, also under
+	// mode "any", where at least one rewritten record must be allowed on top
+	// of the base record.
+	BaseResourceAttributes *ResourceAttributes `json:"baseResourceAttributes,omitempty"`
+	// NonResourceAttributes, when set, fixes the path (and optionally the
+	// verb) used for non-resource SubjectAccessReviews, instead of checking
+	// every authenticated user against the live request path.
+	NonResourceAttributes *NonResourceAttributes `json:"nonResourceAttributes,omitempty"`
+	// AllowedNamespaces restricts the namespaces a rewrite may derive from
+	// request data. When rewrites are configured and the list is non-empty,
+	// any templated attribute whose namespace falls outside the list is
+	// rejected with a 403 before a SubjectAccessReview is issued.
+	AllowedNamespaces []string `json:"allowedNamespaces,omitempty"`
+	// OptionsVerb, when non-empty, is the authorization verb used for OPTIONS
+	// requests, which otherwise do not map to a verb.
+	OptionsVerb string `json:"optionsVerb,omitempty"`
+	// VerbOverrides maps HTTP methods (upper-case) to authorization verbs,
+	// merged over the built-in mapping. It can both change existing entries
+	// (e.g. PATCH to "update") and map methods the built-in table leaves
+	// unmapped. It only applies to resource requests.
+	VerbOverrides map[string]string `json:"verbOverrides,omitempty"`
+	// NonResourceVerbOverrides maps HTTP methods to the verb used for
+	// non-resource SubjectAccessReviews, overriding the default of the
+	// lowercased method (get, post, ...). Kept separate from VerbOverrides
+	// because non-resource policies are conventionally written against the
+	// method-derived verbs.
+	NonResourceVerbOverrides map[string]string `json:"nonResourceVerbOverrides,omitempty"`
+	// DefaultVerb is used for HTTP methods that do not map to a known
+	// authorization verb. When empty, requests with an unmappable method are
+	// rejected with a 405 instead of issuing a SubjectAccessReview that is
+	// doomed to be denied.
+	DefaultVerb string `json:"defaultVerb,omitempty"`
+	// AuthorizeVerbs, when non-empty, lists the verbs that require a
+	// SubjectAccessReview; attribute records mapping to any other verb are
+	// allowed after successful authentication alone. This lets e.g. a
+	// read-only telemetry sidecar require authorization only for mutating
+	// verbs. Empty authorizes every verb, as before.
+	AuthorizeVerbs []string `json:"authorizeVerbs,omitempty"`
+	// SkipAuthorizationForUserAgents lists exact User-Agent values for which
+	// the SubjectAccessReview is skipped after successful authentication.
+	// This is a narrow optimization for known internal agents; every skipped
+	// authorization is logged.
+	SkipAuthorizationForUserAgents []string `json:"skipAuthorizationForUserAgents,omitempty"`
+	// MaxReasonLength caps the length of the reason string captured from an
+	// authorizer response when logging decisions. A misbehaving policy engine
+	// can return arbitrarily large reasons; anything beyond the limit is
+	// truncated. Defaults to 1024 when zero.
+	MaxReasonLength int `json:"maxReasonLength,omitempty"`
+	// AllowCacheTTL is how long allow decisions from the webhook authorizer
+	// are cached. Defaults to 5 minutes when zero.
+	AllowCacheTTL time.Duration `json:"allowCacheTTL,omitempty"`
+	// DenyCacheTTL is how long deny decisions from the webhook authorizer are
+	// cached; keeping it short makes newly granted access visible quickly.
+	// Defaults to 30 seconds when zero.
+	DenyCacheTTL time.Duration `json:"denyCacheTTL,omitempty"`
+	// IncludeSelectors, when true, copies the request's fieldSelector and
+	// labelSelector query parameters into the SubjectAccessReview extra
+	// (keyed "authorization.kubernetes.io/field-selector" and
+	// "authorization.kubernetes.io/label-selector"), so selector-aware
+	// authorizers can restrict by them. The vendored authorization API
+	// predates first-class selector fields in the SAR spec, hence the extra.
+	IncludeSelectors bool `json:"includeSelectors,omitempty"`
+	// PathRules maps request paths to the resource attributes used for their
+	// SubjectAccessReview. When at least one rule matches a request, the
+	// matched rules take precedence over the top-level ResourceAttributes;
+	// when none matches, the top-level configuration applies unchanged.
+	PathRules []PathAuthorizationRule `json:"pathRules,omitempty"`
+	// RuleMatchStrategy selects the behavior when several path rules match
+	// the same request: "first-match" (the default) uses the first matching
+	// rule in configuration order, "most-specific" uses the matching rule
+	// with the longest path pattern, and "all-must-pass" authorizes against
+	// every matching rule and requires all of them to allow.
+	RuleMatchStrategy string `json:"ruleMatchStrategy,omitempty"`
+	// TenantMetrics, when true, additionally counts authorization outcomes
+	// per value captured by the configured rewrites, giving per-tenant
+	// observability in multi-tenant setups. Captured values are request
+	// data; pair this with the metrics label allowlist so that unexpected
+	// values cannot explode metric cardinality.
+	TenantMetrics bool `json:"tenantMetrics,omitempty"`
+}
+
+// PathAuthorizationRule ties a request path to the resource attributes used
+// for its SubjectAccessReview.
+type PathAuthorizationRule struct {
+	// Path is an exact path or a prefix ending in '*', matched against the
+	// cleaned request path.
+	Path               string              `json:"path,omitempty"`
+	ResourceAttributes *ResourceAttributes `json:"resourceAttributes,omitempty"`
+	// RequiredScopes lists OAuth2 scopes the request's bearer token must all
+	// carry (in its scope or scp claim) to access this path, checked before
+	// the SubjectAccessReview. Requests without a scoped token are rejected
+	// on paths that require scopes.
+	RequiredScopes []string `json:"requiredScopes,omitempty"`
+	// AuthorizationHeaderPolicy controls what happens to the client's
+	// Authorization header on this path once the request is allowed: "strip"
+	// removes it so the upstream only sees the injected identity headers,
+	// "pass" (and empty) forwards it for upstreams doing their own token
+	// validation.
+	AuthorizationHeaderPolicy string `json:"authorizationHeaderPolicy,omitempty"`
+	// UseLocalSAR, when true, authorizes this rule's attributes with a
+	// namespace-scoped LocalSubjectAccessReview in the rule's namespace
+	// instead of a cluster-scoped SubjectAccessReview, so the proxy's RBAC
+	// can be limited to the namespaces its rules reference. Requires the
+	// rule's resourceAttributes to carry a namespace.
+	UseLocalSAR bool `json:"useLocalSubjectAccessReview,omitempty"`
+}
+
+// The supported values for PathAuthorizationRule.AuthorizationHeaderPolicy.
+const (
+	AuthorizationHeaderStrip = "strip"
+	AuthorizationHeaderPass  = "pass"
+)
+
+// The supported values for AuthzConfig.RuleMatchStrategy.
+const (
+	RuleMatchFirst        = "first-match"
+	RuleMatchMostSpecific = "most-specific"
+	RuleMatchAllMustPass  = "all-must-pass"
+)
+
+// SubjectAccessReviewRewrites describes how SubjectAccessReview attributes
+// are rewritten from values captured out of the incoming request.
+type SubjectAccessReviewRewrites struct {
+	ByQueryParameter *QueryParameterRewriteConfig `json:"byQueryParameter,omitempty"`
+	ByHTTPHeader     *HTTPHeaderRewriteConfig     `json:"byHttpHeader,omitempty"`
+	ByPathRegex      *PathRegexRewriteConfig      `json:"byPathRegex,omitempty"`
+	// MaxValueLength caps the length of a captured value that is fed into
+	// the resource-attribute templates. Requests carrying larger values are
+	// rejected as malformed. Defaults to 1024 when zero.
+	MaxValueLength int `json:"maxValueLength,omitempty"`
+	// MaxOutputLength caps the rendered size of a single templated attribute
+	// field, guarding template execution against memory abuse. Defaults to
+	// 4096 when zero.
+	MaxOutputLength int `json:"maxOutputLength,omitempty"`
+}
+
+// QueryParameterRewriteConfig captures a query parameter whose values are
+// templated into the configured resource attributes.
+type QueryParameterRewriteConfig struct {
+	Name string `json:"name,omitempty"`
+	// VerbParameter optionally names a second query parameter supplying the
+	// authorization verb per captured value: the i-th value of VerbParameter
+	// applies to the i-th value of Name. Captured values without a positional
+	// verb fall back to the uniform verb derived from the HTTP method, which
+	// is also the behavior when VerbParameter is unset.
+	VerbParameter string `json:"verbParameter,omitempty"`
+	// Mode selects how the attribute records fanned out from multiple
+	// captured values combine: "all" (the default) requires every record to
+	// be allowed, "any" authorizes the request as soon as one record is
+	// allowed.
+	Mode string `json:"mode,omitempty"`
+	// ValueRegex, when non-empty, is a regular expression every captured
+	// value must match in full (e.g. a tenant ID pattern) before it is fed
+	// into the resource-attribute templates. Requests carrying non-matching
+	// values are rejected as malformed.
+	ValueRegex string `json:"valueRegex,omitempty"`
+}
+
+// The supported values for QueryParameterRewriteConfig.Mode.
+const (
+	RewriteModeAll = "all"
+	RewriteModeAny = "any"
+)
+
+// HTTPHeaderRewriteConfig captures a request header whose values are
+// templated into the configured resource attributes, for upstreams passing
+// e.g. a tenant identifier in a header instead of the query string.
+type HTTPHeaderRewriteConfig struct {
+	Name string `json:"name,omitempty"`
+	// ValueRegex, when non-empty, is a regular expression every captured
+	// value must match in full before it is fed into the
+	// resource-attribute templates. Requests carrying non-matching values
+	// are rejected as malformed.
+	ValueRegex string `json:"valueRegex,omitempty"`
+}
+
+// PathRegexRewriteConfig captures values out of the request path for
+// RESTful upstreams where e.g. the tenant lives in the URL (such as
+// "/api/v1/tenants/(?P<tenant>[a-z0-9-]+)/.*"). Named capture groups are
+// exposed to the attribute templates as {{ .Captures.<name> }}; the full
+// match becomes the record's {{ .Value }}. A request whose path does not
+// match the pattern is rejected as malformed, like a missing query
+// parameter.
+type PathRegexRewriteConfig struct {
+	Pattern string `json:"pattern,omitempty"`
 }
 
+const (
+	defaultRewriteMaxValueLength  = 1024
+	defaultRewriteMaxOutputLength = 4096
+	defaultMaxReasonLength        = 1024
+)
+
 type AuthnHeaderConfig struct {
 	// When set to true, kube-rbac-proxy adds auth-related fields to the headers of http requests sent to the upstream
 	Enabled bool
@@ -60,6 +398,20 @@ type AuthnHeaderConfig struct {
 	GroupsFieldName string
 	// The separator string used for concatenating multiple group names in a groups header field's value
 	GroupSeparator string
+	// GroupsAsRepeatedHeader, when true, emits one groups header line per
+	// group instead of a single value joined by GroupSeparator, for upstreams
+	// that expect repeated header lines. A user without groups gets no groups
+	// header at all in this mode.
+	GroupsAsRepeatedHeader bool
+	// Encoding selects how identity values containing control characters are
+	// treated before being placed in headers: "sanitize" (the default) strips
+	// them, "encode" percent-encodes them, "reject" refuses the request.
+	Encoding string
+	// ExtraFieldPrefix, when non-empty, causes every entry of the
+	// authenticated user's extra map to be forwarded as a header named
+	// "<prefix><key>", with multiple values joined by GroupSeparator. Extra
+	// keys are sanitized to valid header token characters before use.
+	ExtraFieldPrefix string
 }
 
 type ResourceAttributes struct {
@@ -69,73 +421,502 @@ type ResourceAttributes struct {
 	Resource    string `json:"resource,omitempty"`
 	Subresource string `json:"subresource,omitempty"`
 	Name        string `json:"name,omitempty"`
+	// ResourceRequest, when explicitly false, turns these attributes into a
+	// non-resource record checking Path with the method-derived non-resource
+	// verb; the resource fields above are then ignored. Unset or true keeps
+	// the resource record. It applies to statically configured records (the
+	// top-level attributes, the base record, path rules); the rewrite
+	// fan-out always produces resource records.
+	ResourceRequest *bool `json:"resourceRequest,omitempty"`
+	// Path is the non-resource path checked when ResourceRequest is false,
+	// fixed regardless of the incoming URL; empty falls back to the request
+	// path. Ignored for resource records.
+	Path string `json:"path,omitempty"`
+}
+
+// NonResourceAttributes fixes the attributes used for non-resource
+// SubjectAccessReviews. An empty Verb keeps the verb derived from the HTTP
+// method.
+type NonResourceAttributes struct {
+	Path string `json:"path,omitempty"`
+	Verb string `json:"verb,omitempty"`
 }
 
 type AuthConfig struct {
 	Authentication *AuthnConfig
 	Authorization  *AuthzConfig
+	// ServerTiming, when true, emits a Server-Timing response header with
+	// the authentication and authorization durations of the request. Off by
+	// default since it exposes internal timing to clients.
+	ServerTiming bool
+	// Timeout bounds each authentication and authorization backend call, so
+	// a hanging TokenReview or SubjectAccessReview endpoint fails the
+	// request promptly instead of blocking it indefinitely. Defaults to 10
+	// seconds when zero; negative disables the bound.
+	Timeout time.Duration
+	// CORS, when non-nil, answers CORS preflight requests from the listed
+	// origins at the proxy, before authentication and authorization —
+	// browsers send preflights without credentials, so they could never
+	// pass auth. Nil (the default) leaves preflight handling to the
+	// embedder.
+	CORS *CORSConfig
+	// ErrorBodies, when non-nil, customizes the client-facing bodies of the
+	// 401, 403 and 500 responses Handle writes. Regardless of the setting,
+	// detail about the denied action (user, verb, resource) stays in the
+	// logs and never reaches the response body.
+	ErrorBodies *ErrorBodyConfig
+	// BackendRateLimit, when non-nil, installs a global token-bucket limiter
+	// on requests reaching the authentication/authorization backends, so a
+	// burst of unauthenticated requests cannot translate into a burst of
+	// TokenReviews/SubjectAccessReviews overloading a shared API server.
+	// Requests exceeding the rate are shed with a 429 and a Retry-After
+	// header instead of queuing.
+	BackendRateLimit *BackendRateLimitConfig
+	// AllowedMethods, when non-empty, lists the HTTP methods the proxy
+	// accepts at all; requests with any other method are rejected with a 405
+	// and an Allow header before any authentication or authorization work.
+	// This locks e.g. a read-only sidecar to GET and HEAD. Empty accepts
+	// every method, as before.
+	AllowedMethods []string
+	// IgnorePaths lists request paths (exact values or prefixes ending in
+	// '*') that skip authentication and authorization entirely and are
+	// proxied through, e.g. an upstream's /healthz. The request path is
+	// normalized before matching, so traversal tricks cannot widen a
+	// pattern's reach.
+	IgnorePaths []string
 }
 
 func (c *AuthConfig) DeepCopy() *AuthConfig {
 	res := &AuthConfig{
 		Authentication: &AuthnConfig{},
+		ServerTiming:   c.ServerTiming,
+		Timeout:        c.Timeout,
+		AllowedMethods: copyStrings(c.AllowedMethods),
+		IgnorePaths:    copyStrings(c.IgnorePaths),
+	}
+
+	if c.BackendRateLimit != nil {
+		res.BackendRateLimit = &BackendRateLimitConfig{
+			QPS:   c.BackendRateLimit.QPS,
+			Burst: c.BackendRateLimit.Burst,
+		}
+	}
+
+	if c.CORS != nil {
+		res.CORS = &CORSConfig{
+			AllowedOrigins: copyStrings(c.CORS.AllowedOrigins),
+			AllowedMethods: copyStrings(c.CORS.AllowedMethods),
+			AllowedHeaders: copyStrings(c.CORS.AllowedHeaders),
+		}
+	}
+
+	if c.ErrorBodies != nil {
+		res.ErrorBodies = &ErrorBodyConfig{Mode: c.ErrorBodies.Mode}
+		if c.ErrorBodies.Overrides != nil {
+			res.ErrorBodies.Overrides = map[string]string{}
+			for status, body := range c.ErrorBodies.Overrides {
+				res.ErrorBodies.Overrides[status] = body
+			}
+		}
 	}
 
 	if c.Authentication != nil {
-		res.Authentication = &AuthnConfig{}
+		res.Authentication = &AuthnConfig{
+			CacheTTL:              c.Authentication.CacheTTL,
+			FailureCacheTTL:       c.Authentication.FailureCacheTTL,
+			CapCacheAtTokenExpiry: c.Authentication.CapCacheAtTokenExpiry,
+			NoCachePaths:          copyStrings(c.Authentication.NoCachePaths),
+			AnonymousPaths:        copyStrings(c.Authentication.AnonymousPaths),
+			StaticGroups:          copyStrings(c.Authentication.StaticGroups),
+			Audiences:             copyStrings(c.Authentication.Audiences),
+			PassthroughToken:      c.Authentication.PassthroughToken,
+			Challenge:             c.Authentication.Challenge,
+		}
+
+		if c.Authentication.CNGroups != nil {
+			res.Authentication.CNGroups = map[string]string{}
+			for cn, group := range c.Authentication.CNGroups {
+				res.Authentication.CNGroups[cn] = group
+			}
+		}
 
 		if c.Authentication.X509 != nil {
 			res.Authentication.X509 = &X509Config{
-				ClientCAFile: c.Authentication.X509.ClientCAFile,
+				ClientCAFile:                  c.Authentication.X509.ClientCAFile,
+				EnforceKeyUsage:               c.Authentication.X509.EnforceKeyUsage,
+				ExtraFields:                   copyStrings(c.Authentication.X509.ExtraFields),
+				MinRSAKeySize:                 c.Authentication.X509.MinRSAKeySize,
+				RejectWeakSignatureAlgorithms: c.Authentication.X509.RejectWeakSignatureAlgorithms,
+				ReloadInterval:                c.Authentication.X509.ReloadInterval,
 			}
 		}
 
 		if c.Authentication.Header != nil {
 			res.Authentication.Header = &AuthnHeaderConfig{
-				Enabled:         c.Authentication.Header.Enabled,
-				UserFieldName:   c.Authentication.Header.UserFieldName,
-				GroupsFieldName: c.Authentication.Header.GroupsFieldName,
-				GroupSeparator:  c.Authentication.Header.GroupSeparator,
+				Enabled:                c.Authentication.Header.Enabled,
+				UserFieldName:          c.Authentication.Header.UserFieldName,
+				GroupsFieldName:        c.Authentication.Header.GroupsFieldName,
+				GroupSeparator:         c.Authentication.Header.GroupSeparator,
+				GroupsAsRepeatedHeader: c.Authentication.Header.GroupsAsRepeatedHeader,
+				Encoding:               c.Authentication.Header.Encoding,
+				ExtraFieldPrefix:       c.Authentication.Header.ExtraFieldPrefix,
+			}
+		}
+
+		if c.Authentication.TrustedHeader != nil {
+			res.Authentication.TrustedHeader = &TrustedHeaderConfig{
+				UserHeader:        c.Authentication.TrustedHeader.UserHeader,
+				GroupsHeader:      c.Authentication.TrustedHeader.GroupsHeader,
+				ExtraHeaderPrefix: c.Authentication.TrustedHeader.ExtraHeaderPrefix,
+				TrustedCIDRs:      copyStrings(c.Authentication.TrustedHeader.TrustedCIDRs),
+				AllowedClientCNs:  copyStrings(c.Authentication.TrustedHeader.AllowedClientCNs),
+				ClientCAFile:      c.Authentication.TrustedHeader.ClientCAFile,
 			}
 		}
 	}
 
 	if c.Authorization != nil {
+		res.Authorization = &AuthzConfig{
+			AllowedNamespaces:              copyStrings(c.Authorization.AllowedNamespaces),
+			AuthorizeVerbs:                 copyStrings(c.Authorization.AuthorizeVerbs),
+			OptionsVerb:                    c.Authorization.OptionsVerb,
+			DefaultVerb:                    c.Authorization.DefaultVerb,
+			SkipAuthorizationForUserAgents: copyStrings(c.Authorization.SkipAuthorizationForUserAgents),
+			MaxReasonLength:                c.Authorization.MaxReasonLength,
+			IncludeSelectors:               c.Authorization.IncludeSelectors,
+			RuleMatchStrategy:              c.Authorization.RuleMatchStrategy,
+			TenantMetrics:                  c.Authorization.TenantMetrics,
+			AllowCacheTTL:                  c.Authorization.AllowCacheTTL,
+			DenyCacheTTL:                   c.Authorization.DenyCacheTTL,
+		}
+
+		if c.Authorization.VerbOverrides != nil {
+			res.Authorization.VerbOverrides = map[string]string{}
+			for method, verb := range c.Authorization.VerbOverrides {
+				res.Authorization.VerbOverrides[method] = verb
+			}
+		}
+
+		if c.Authorization.NonResourceVerbOverrides != nil {
+			res.Authorization.NonResourceVerbOverrides = map[string]string{}
+			for method, verb := range c.Authorization.NonResourceVerbOverrides {
+				res.Authorization.NonResourceVerbOverrides[method] = verb
+			}
+		}
+
+		if c.Authorization.Rewrites != nil {
+			res.Authorization.Rewrites = &SubjectAccessReviewRewrites{
+				MaxValueLength:  c.Authorization.Rewrites.MaxValueLength,
+				MaxOutputLength: c.Authorization.Rewrites.MaxOutputLength,
+			}
+			if c.Authorization.Rewrites.ByQueryParameter != nil {
+				res.Authorization.Rewrites.ByQueryParameter = &QueryParameterRewriteConfig{
+					Name:          c.Authorization.Rewrites.ByQueryParameter.Name,
+					VerbParameter: c.Authorization.Rewrites.ByQueryParameter.VerbParameter,
+					Mode:          c.Authorization.Rewrites.ByQueryParameter.Mode,
+					ValueRegex:    c.Authorization.Rewrites.ByQueryParameter.ValueRegex,
+				}
+			}
+			if c.Authorization.Rewrites.ByHTTPHeader != nil {
+				res.Authorization.Rewrites.ByHTTPHeader = &HTTPHeaderRewriteConfig{
+					Name:       c.Authorization.Rewrites.ByHTTPHeader.Name,
+					ValueRegex: c.Authorization.Rewrites.ByHTTPHeader.ValueRegex,
+				}
+			}
+			if c.Authorization.Rewrites.ByPathRegex != nil {
+				res.Authorization.Rewrites.ByPathRegex = &PathRegexRewriteConfig{
+					Pattern: c.Authorization.Rewrites.ByPathRegex.Pattern,
+				}
+			}
+		}
+
 		if c.Authorization.ResourceAttributes != nil {
-			res.Authorization = &AuthzConfig{
-				ResourceAttributes: &ResourceAttributes{
-					Namespace:   c.Authorization.ResourceAttributes.Namespace,
-					APIGroup:    c.Authorization.ResourceAttributes.APIGroup,
-					APIVersion:  c.Authorization.ResourceAttributes.APIVersion,
-					Resource:    c.Authorization.ResourceAttributes.Resource,
-					Subresource: c.Authorization.ResourceAttributes.Subresource,
-					Name:        c.Authorization.ResourceAttributes.Name,
-				},
+			res.Authorization.ResourceAttributes = c.Authorization.ResourceAttributes.DeepCopy()
+		}
+
+		if c.Authorization.BaseResourceAttributes != nil {
+			res.Authorization.BaseResourceAttributes = c.Authorization.BaseResourceAttributes.DeepCopy()
+		}
+
+		if c.Authorization.NonResourceAttributes != nil {
+			res.Authorization.NonResourceAttributes = &NonResourceAttributes{
+				Path: c.Authorization.NonResourceAttributes.Path,
+				Verb: c.Authorization.NonResourceAttributes.Verb,
 			}
 		}
+
+		for _, rule := range c.Authorization.PathRules {
+			ruleCopy := PathAuthorizationRule{
+				Path:                      rule.Path,
+				RequiredScopes:            copyStrings(rule.RequiredScopes),
+				AuthorizationHeaderPolicy: rule.AuthorizationHeaderPolicy,
+				UseLocalSAR:               rule.UseLocalSAR,
+			}
+			if rule.ResourceAttributes != nil {
+				ruleCopy.ResourceAttributes = rule.ResourceAttributes.DeepCopy()
+			}
+			res.Authorization.PathRules = append(res.Authorization.PathRules, ruleCopy)
+		}
 	}
 
 	return res
 }
 
+func (r *ResourceAttributes) DeepCopy() *ResourceAttributes {
+	res := &ResourceAttributes{
+		Namespace:   r.Namespace,
+		APIGroup:    r.APIGroup,
+		APIVersion:  r.APIVersion,
+		Resource:    r.Resource,
+		Subresource: r.Subresource,
+		Name:        r.Name,
+		Path:        r.Path,
+	}
+	if r.ResourceRequest != nil {
+		resourceRequest := *r.ResourceRequest
+		res.ResourceRequest = &resourceRequest
+	}
+	return res
+}
+
+func copyStrings(in []string) []string {
+	if in == nil {
+		return nil
+	}
+	out := make([]string, len(in))
+	copy(out, in)
+	return out
+}
+
 // kubeRBACProxyAuth implements AuthInterface
 type kubeRBACProxyAuth struct {
 	// authenticator identifies the user for requests to kube-rbac-proxy
 	authenticator.Request
-	// authorizerAttributeGetter builds authorization.Attributes for a request to kube-rbac-proxy
-	authorizer.RequestAttributesGetter
+	// authorizerAttributesGetter builds authorization.Attributes for a request to kube-rbac-proxy
+	authorizerAttributesGetter *krpAuthorizerAttributesGetter
 	// authorizer determines whether a given authorization.Attributes is allowed
 	authorizer.Authorizer
+	// selfAuthorizer, when set, replaces the authorizer with
+	// SelfSubjectAccessReviews issued with the caller's own token
+	selfAuthorizer *selfSubjectAccessReviewAuthorizer
+	// backendLimiter, when set, caps the global rate at which requests may
+	// reach the authentication/authorization backends
+	backendLimiter flowcontrol.RateLimiter
+	// proxyIdentity, when non-empty, is added to the extra of every
+	// SubjectAccessReview so audit logs show which proxy instance issued it
+	proxyIdentity string
+	// tokenClient and sarClient are the raw backend clients, retained for
+	// the Healthy self-check; either may be nil when the corresponding
+	// backend is not in use.
+	tokenClient authenticationclient.TokenReviewInterface
+	sarClient   authorizationclient.SubjectAccessReviewInterface
+	// localSARAuthorizer serves path rules asking for namespace-scoped
+	// LocalSubjectAccessReviews; nil without a Kubernetes client.
+	localSARAuthorizer *localSubjectAccessReviewAuthorizer
+	// logger receives the handler's per-request log output; defaults to a
+	// glog-backed logger, replaceable via SetLogger.
+	logger Logger
+	// reloader re-reads the handler's reloadable state (CA bundles) on
+	// demand; exposed via Reloader so callers can hook it to a signal.
+	reloader *Reloader
 	// config for kube-rbac-proxy
 	Config *AuthConfig
 }
 
+// EnableSelfSubjectAccessReview switches authorization to
+// SelfSubjectAccessReviews issued with the caller's own bearer token, for
+// environments where the proxy must not hold permission to create
+// SubjectAccessReviews. Only token-based clients can be authorized in this
+// mode; see selfSubjectAccessReviewAuthorizer for the tradeoffs.
+func (h *kubeRBACProxyAuth) EnableSelfSubjectAccessReview(restConfig *rest.Config) {
+	h.selfAuthorizer = &selfSubjectAccessReviewAuthorizer{restConfig: restConfig}
+}
+
+// SetProxyIdentity annotates every SubjectAccessReview with the given
+// identity (e.g. the pod name from the downward API) in the extra field
+// "kube-rbac-proxy/identity", so the API server audit log shows which proxy
+// instance issued it in multi-proxy deployments.
+func (h *kubeRBACProxyAuth) SetProxyIdentity(identity string) {
+	h.proxyIdentity = identity
+}
+
+// EnableBackendRateLimit installs a global token-bucket limiter on requests
+// reaching the authentication/authorization backends, so that a single busy
+// proxy cannot overwhelm a shared API server. Requests exceeding the rate are
+// shed with a 429 and a Retry-After header. Note that requests served from
+// the decision caches consume tokens too; the limit is a conservative upper
+// bound on backend calls. Equivalent to setting BackendRateLimit on the
+// config before building the handler.
+func (h *kubeRBACProxyAuth) EnableBackendRateLimit(qps float32, burst int) {
+	h.backendLimiter = flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+}
+
+// Healthy reports whether the authentication and authorization backends are
+// reachable and the proxy is permitted to use them, by issuing a no-op
+// TokenReview and a SubjectAccessReview for the proxy's own identity. It lets
+// callers wire backend connectivity into a readiness endpoint, so a proxy
+// started with a bad kubeconfig or missing RBAC permissions fails readiness
+// instead of serving per-request 500s. Backends the proxy is not configured
+// to use are skipped.
+func (h *kubeRBACProxyAuth) Healthy(ctx context.Context) error {
+	// The vendored clients take no context; run each probe in a goroutine
+	// and bound it by the caller's context instead.
+	check := func(name string, fn func() error) error {
+		var err error
+		done := make(chan struct{})
+		go func() {
+			err = fn()
+			close(done)
+		}()
+		select {
+		case <-done:
+			if err != nil {
+				return fmt.Errorf("%s self-check failed: %v", name, err)
+			}
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("%s self-check failed: %v", name, ctx.Err())
+		}
+	}
+
+	if h.tokenClient != nil {
+		if err := check("TokenReview", func() error {
+			// The review is expected to come back unauthenticated; only the
+			// API call itself has to succeed.
+			_, err := h.tokenClient.Create(&authenticationapi.TokenReview{
+				Spec: authenticationapi.TokenReviewSpec{Token: "kube-rbac-proxy-readiness-probe"},
+			})
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	if h.sarClient != nil {
+		if err := check("SubjectAccessReview", func() error {
+			// The decision is irrelevant; the probe only verifies the proxy
+			// may create SubjectAccessReviews at all.
+			_, err := h.sarClient.Create(&authorizationapi.SubjectAccessReview{
+				Spec: authorizationapi.SubjectAccessReviewSpec{
+					User: "system:kube-rbac-proxy:readiness-probe",
+					NonResourceAttributes: &authorizationapi.NonResourceAttributes{
+						Path: "/healthz",
+						Verb: "get",
+					},
+				},
+			})
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func newKubeRBACProxyAuth(authenticator authenticator.Request, authorizer authorizer.Authorizer, authConfig *AuthConfig) *kubeRBACProxyAuth {
-	return &kubeRBACProxyAuth{authenticator, newKubeRBACProxyAuthorizerAttributesGetter(authConfig.Authorization), authorizer, authConfig}
+	h := &kubeRBACProxyAuth{
+		Request:                    authenticator,
+		authorizerAttributesGetter: newKubeRBACProxyAuthorizerAttributesGetter(authConfig.Authorization),
+		Authorizer:                 authorizer,
+		Config:                     authConfig,
+		logger:                     glogLogger{},
+	}
+	if rl := authConfig.BackendRateLimit; rl != nil && rl.QPS > 0 {
+		h.backendLimiter = flowcontrol.NewTokenBucketRateLimiter(rl.QPS, rl.Burst)
+	}
+	return h
+}
+
+// Validate checks the configuration for errors that would otherwise only
+// surface while serving requests. It is called by the handler constructors,
+// so misconfiguration fails at startup rather than at request time.
+func (c *AuthConfig) Validate() error {
+	if c.Authentication != nil {
+		if err := c.Authentication.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Authorization != nil {
+		return c.Authorization.Validate()
+	}
+	return nil
+}
+
+// Validate checks the identity header injection configuration. An empty field
+// name would make Handle call Header.Set with an empty key, and a field name
+// or group separator containing invalid characters (notably CR/LF) could
+// corrupt or inject upstream headers; both are rejected at build time. The
+// header values themselves are handled per request by encodeHeaderValue.
+func (c *AuthnConfig) Validate() error {
+	header := c.Header
+	if header == nil || !header.Enabled {
+		return nil
+	}
+	if header.UserFieldName == "" || header.GroupsFieldName == "" {
+		return errors.New("authentication header injection requires non-empty user and groups field names")
+	}
+	for _, name := range []string{header.UserFieldName, header.GroupsFieldName} {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid authentication header field name %q", name)
+		}
+	}
+	if header.ExtraFieldPrefix != "" && !validHeaderName(header.ExtraFieldPrefix) {
+		return fmt.Errorf("invalid authentication header extra field prefix %q", header.ExtraFieldPrefix)
+	}
+	if strings.ContainsFunc(header.GroupSeparator, isHeaderUnsafe) {
+		return errors.New("authentication header group separator must not contain control characters")
+	}
+	return nil
+}
+
+// Validate checks that every rewrite template parses and every configured
+// value regex compiles. A malformed template would otherwise silently render
+// to an empty string and make every authorization check an unexpected
+// resource.
+func (c *AuthzConfig) Validate() error {
+	if c.Rewrites == nil {
+		return nil
+	}
+	if byQuery := c.Rewrites.ByQueryParameter; byQuery != nil && byQuery.ValueRegex != "" {
+		if _, err := compileValueRegex(byQuery.ValueRegex); err != nil {
+			return fmt.Errorf("invalid valueRegex in rewrites.byQueryParameter: %v", err)
+		}
+	}
+	if byHeader := c.Rewrites.ByHTTPHeader; byHeader != nil && byHeader.ValueRegex != "" {
+		if _, err := compileValueRegex(byHeader.ValueRegex); err != nil {
+			return fmt.Errorf("invalid valueRegex in rewrites.byHttpHeader: %v", err)
+		}
+	}
+	if byPath := c.Rewrites.ByPathRegex; byPath != nil && byPath.Pattern != "" {
+		if _, err := regexp.Compile(byPath.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern in rewrites.byPathRegex: %v", err)
+		}
+	}
+	if c.ResourceAttributes == nil {
+		return nil
+	}
+	for field, templateString := range templatedFields(c.ResourceAttributes) {
+		if _, err := template.New("valueTemplate").Parse(templateString); err != nil {
+			return fmt.Errorf("invalid template in resourceAttributes.%s: %v", field, err)
+		}
+	}
+	return nil
+}
+
+// compileValueRegex compiles a capture validation pattern anchored to the
+// whole value, so a pattern like "[a-z0-9-]+" cannot be satisfied by a
+// merely partial match.
+func compileValueRegex(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
 }
 
 // BuildAuthHandler creates an authenticator, an authorizer, and a matching authorizer attributes getter compatible with the kube-rbac-proxy
 func BuildAuthHandler(client clientset.Interface, config *AuthConfig) (*kubeRBACProxyAuth, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
 	// Get clients, if provided
 	var (
 		tokenClient authenticationclient.TokenReviewInterface
@@ -146,25 +927,74 @@ func BuildAuthHandler(client clientset.Interface, config *AuthConfig) (*kubeRBAC
 		sarClient = client.AuthorizationV1beta1().SubjectAccessReviews()
 	}
 
-	authenticator, err := buildAuthn(tokenClient, config.Authentication)
+	reloader := NewReloader()
+	authenticator, err := buildAuthn(tokenClient, config.Authentication, reloader)
 	if err != nil {
 		return nil, err
 	}
 
-	authorizer, err := buildAuthz(sarClient)
+	authorizer, err := buildAuthz(sarClient, config.Authorization)
 	if err != nil {
 		return nil, err
 	}
 
-	return newKubeRBACProxyAuth(authenticator, authorizer, config), nil
+	h := newKubeRBACProxyAuth(authenticator, authorizer, config)
+	h.reloader = reloader
+	h.tokenClient = tokenClient
+	h.sarClient = sarClient
+	if client != nil && !reflect.ValueOf(client).IsNil() {
+		h.localSARAuthorizer = &localSubjectAccessReviewAuthorizer{client: client.AuthorizationV1beta1()}
+	}
+	return h, nil
 }
 
-// buildAuthn creates an authenticator compatible with the kubelet's needs
-func buildAuthn(client authenticationclient.TokenReviewInterface, authn *AuthnConfig) (authenticator.Request, error) {
+// BuildAuthHandlerWithAuthorizer is BuildAuthHandler with a caller-supplied
+// authorizer in place of the delegating webhook authorizer, for embedders
+// that bring their own authorization (caching layers, static allowlists,
+// tests). The client is then only used for token authentication and may be
+// nil when authentication is purely certificate- or header-based.
+func BuildAuthHandlerWithAuthorizer(client clientset.Interface, authz authorizer.Authorizer, config *AuthConfig) (*kubeRBACProxyAuth, error) {
+	if authz == nil {
+		return nil, errors.New("no authorizer provided")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	var tokenClient authenticationclient.TokenReviewInterface
+	if client != nil && !reflect.ValueOf(client).IsNil() {
+		tokenClient = client.AuthenticationV1beta1().TokenReviews()
+	}
+
+	reloader := NewReloader()
+	authenticator, err := buildAuthn(tokenClient, config.Authentication, reloader)
+	if err != nil {
+		return nil, err
+	}
+
+	h := newKubeRBACProxyAuth(authenticator, authz, config)
+	h.reloader = reloader
+	h.tokenClient = tokenClient
+	return h, nil
+}
+
+// Reloader returns the reloader holding the handler's reloadable state — the
+// client CA bundles of certificate and trusted-header authentication. Calling
+// its Reload re-reads them on demand, e.g. from a SIGHUP handler, independent
+// of any periodic reload interval.
+func (h *kubeRBACProxyAuth) Reloader() *Reloader {
+	return h.reloader
+}
+
+// newDelegatingAuthenticator creates a delegating authenticator with the
+// given token authentication cache TTL.
+func newDelegatingAuthenticator(client authenticationclient.TokenReviewInterface, authn *AuthnConfig, cacheTTL time.Duration) (authenticator.Request, error) {
+	// The reloading x509 authenticator owns client certificate verification;
+	// loading the CA here as well would pin a second, startup-time copy of
+	// the bundle next to the reloading one.
 	authenticatorConfig := authenticatorfactory.DelegatingAuthenticatorConfig{
-		Anonymous:    false, // always require authentication
-		CacheTTL:     2 * time.Minute,
-		ClientCAFile: authn.X509.ClientCAFile,
+		Anonymous: false, // always require authentication
+		CacheTTL:  cacheTTL,
 	}
 
 	if client == nil {
@@ -176,120 +1006,1272 @@ func buildAuthn(client authenticationclient.TokenReviewInterface, authn *AuthnCo
 	return authenticator, err
 }
 
+// defaultAuthnCacheTTL is how long successful TokenReview results are cached
+// when no TTL is configured.
+const defaultAuthnCacheTTL = 2 * time.Minute
+
+// defaultAuthTimeout bounds authentication and authorization backend calls
+// when no timeout is configured.
+const defaultAuthTimeout = 10 * time.Second
+
+// callWithTimeout runs fn, waiting at most the given timeout for it to
+// finish. The vendored authenticator and authorizer interfaces take no
+// context, so an overrunning call cannot be cancelled — its goroutine
+// completes in the background — but the caller gets a timely answer instead
+// of blocking on a hanging backend.
+func callWithTimeout(timeout time.Duration, fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// buildAuthn creates an authenticator compatible with the kubelet's needs
+func buildAuthn(client authenticationclient.TokenReviewInterface, authn *AuthnConfig, reloader *Reloader) (authenticator.Request, error) {
+	cacheTTL := authn.CacheTTL
+	if cacheTTL == 0 {
+		cacheTTL = defaultAuthnCacheTTL
+	}
+	if cacheTTL < 0 {
+		return nil, fmt.Errorf("authentication cache TTL must not be negative, got %v", cacheTTL)
+	}
+	if authn.FailureCacheTTL < 0 {
+		return nil, fmt.Errorf("authentication failure cache TTL must not be negative, got %v", authn.FailureCacheTTL)
+	}
+
+	var reloadingX509 authenticator.Request
+	if authn.X509 != nil && authn.X509.ClientCAFile != "" {
+		// Client certificates are always verified against a reloadable pool:
+		// the bundle is re-read periodically when a reload interval is
+		// configured, and on demand through the reloader either way.
+		pool, err := newReloadableCertPool(authn.X509.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		reloader.Register("client CA bundle "+authn.X509.ClientCAFile, pool.reload)
+		if authn.X509.ReloadInterval > 0 {
+			go pool.watch(authn.X509.ReloadInterval)
+		}
+		reloadingX509 = &reloadingX509Authenticator{pool: pool}
+	}
+
+	authenticator, err := newDelegatingAuthenticator(client, authn, cacheTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(authn.NoCachePaths) > 0 {
+		// Sensitive paths revalidate on every request through a second,
+		// uncached authenticator.
+		uncached, err := newDelegatingAuthenticator(client, authn, 0)
+		if err != nil {
+			return nil, err
+		}
+		authenticator = &pathCacheBypassAuthenticator{
+			cached:   authenticator,
+			uncached: uncached,
+			paths:    authn.NoCachePaths,
+		}
+	}
+
+	if authn.CapCacheAtTokenExpiry {
+		// A cache entry may outlive the token it was created for when the
+		// cache TTL exceeds the token's remaining lifetime; expired tokens
+		// are then revalidated instead of served from the cache.
+		uncached, err := newDelegatingAuthenticator(client, authn, 0)
+		if err != nil {
+			return nil, err
+		}
+		authenticator = &expiryAwareAuthenticator{
+			cached:   authenticator,
+			uncached: uncached,
+		}
+	}
+
+	if len(authn.Audiences) > 0 {
+		// The vendored TokenReview API predates audience support, so the
+		// audience scope cannot be delegated to the API server. It is
+		// enforced locally instead, against the aud claim of the presented
+		// token; the delegating authenticator still validates the token
+		// itself.
+		authenticator = &audienceValidatingAuthenticator{
+			delegate:  authenticator,
+			audiences: authn.Audiences,
+		}
+	}
+
+	if reloadingX509 != nil {
+		// Client certificates are verified against the most recently loaded
+		// CA pool, so a rotated CA is honored without a restart. The
+		// delegating authenticator is left without a CA file in this mode and
+		// only handles bearer tokens.
+		authenticator = unionauth.New(group.NewAuthenticatedGroupAdder(reloadingX509), authenticator)
+	}
+
+	if authn.TrustedHeader != nil && authn.TrustedHeader.UserHeader != "" {
+		trustedHeader, err := newTrustedHeaderAuthenticator(authn.TrustedHeader, reloader)
+		if err != nil {
+			return nil, err
+		}
+		// The trusted-header authenticator is consulted first; it only yields
+		// an identity for connections originating from a trusted peer CIDR,
+		// everything else falls through to the delegating authenticator.
+		authenticator = unionauth.New(group.NewAuthenticatedGroupAdder(trustedHeader), authenticator)
+	}
+
+	if authn.FailureCacheTTL > 0 {
+		negative := newNegativeCachingAuthenticator(authenticator, authn.FailureCacheTTL)
+		// Expired failure entries are also swept in the background, so a burst
+		// of distinct invalid tokens does not keep memory pinned until the
+		// cache happens to fill up and evict.
+		go negative.sweep(authn.FailureCacheTTL)
+		authenticator = negative
+	}
+
+	return authenticator, nil
+}
+
 // buildAuthz creates an authorizer compatible with the kubelet's needs
-func buildAuthz(client authorizationclient.SubjectAccessReviewInterface) (authorizer.Authorizer, error) {
+func buildAuthz(client authorizationclient.SubjectAccessReviewInterface, authz *AuthzConfig) (authorizer.Authorizer, error) {
 	if client == nil {
 		return nil, errors.New("no client provided, cannot use webhook authorization")
 	}
+
+	allowCacheTTL := authz.AllowCacheTTL
+	if allowCacheTTL == 0 {
+		allowCacheTTL = 5 * time.Minute
+	}
+	denyCacheTTL := authz.DenyCacheTTL
+	if denyCacheTTL == 0 {
+		denyCacheTTL = 30 * time.Second
+	}
+
 	authorizerConfig := authorizerfactory.DelegatingAuthorizerConfig{
 		SubjectAccessReviewClient: client,
-		AllowCacheTTL:             5 * time.Minute,
-		DenyCacheTTL:              30 * time.Second,
+		AllowCacheTTL:             allowCacheTTL,
+		DenyCacheTTL:              denyCacheTTL,
 	}
 	return authorizerConfig.New()
 }
 
-func newKubeRBACProxyAuthorizerAttributesGetter(authzConfig *AuthzConfig) authorizer.RequestAttributesGetter {
-	return krpAuthorizerAttributesGetter{authzConfig}
+func newKubeRBACProxyAuthorizerAttributesGetter(authzConfig *AuthzConfig) *krpAuthorizerAttributesGetter {
+	g := &krpAuthorizerAttributesGetter{
+		authzConfig: authzConfig,
+		templates:   map[string]*template.Template{},
+		logger:      glogLogger{},
+	}
+	// Parse the rewrite templates and value regexes once instead of on every
+	// request. Malformed ones are caught by Validate before this constructor
+	// runs.
+	if authzConfig != nil && authzConfig.Rewrites != nil {
+		if byQuery := authzConfig.Rewrites.ByQueryParameter; byQuery != nil && byQuery.ValueRegex != "" {
+			g.queryValueRegex, _ = compileValueRegex(byQuery.ValueRegex)
+		}
+		if byHeader := authzConfig.Rewrites.ByHTTPHeader; byHeader != nil && byHeader.ValueRegex != "" {
+			g.headerValueRegex, _ = compileValueRegex(byHeader.ValueRegex)
+		}
+		if byPath := authzConfig.Rewrites.ByPathRegex; byPath != nil && byPath.Pattern != "" {
+			g.pathRegex, _ = regexp.Compile(byPath.Pattern)
+		}
+		if authzConfig.ResourceAttributes != nil {
+			for _, templateString := range templatedFields(authzConfig.ResourceAttributes) {
+				if tmpl, err := template.New("valueTemplate").Parse(templateString); err == nil {
+					g.templates[templateString] = tmpl
+				}
+			}
+		}
+	}
+	return g
 }
 
 type krpAuthorizerAttributesGetter struct {
 	authzConfig *AuthzConfig
+	// templates caches the parsed rewrite templates, keyed by their source
+	// string.
+	templates map[string]*template.Template
+	// queryValueRegex and headerValueRegex, when non-nil, are the compiled,
+	// fully-anchored patterns every captured value of the respective rewrite
+	// must match.
+	queryValueRegex  *regexp.Regexp
+	headerValueRegex *regexp.Regexp
+	// pathRegex, when non-nil, is the compiled byPathRegex pattern matched
+	// against the request path.
+	pathRegex *regexp.Regexp
+	// logger receives the getter's log output; shared with the owning
+	// handler's logger.
+	logger Logger
 }
 
-// GetRequestAttributes populates authorizer attributes for the requests to kube-rbac-proxy.
-func (n krpAuthorizerAttributesGetter) GetRequestAttributes(u user.Info, r *http.Request) authorizer.Attributes {
-	apiVerb := ""
-	switch r.Method {
-	case "POST":
-		apiVerb = "create"
-	case "GET":
-		apiVerb = "get"
-	case "PUT":
-		apiVerb = "update"
-	case "PATCH":
-		apiVerb = "patch"
-	case "DELETE":
-		apiVerb = "delete"
-	}
-
-	requestPath := r.URL.Path
-	// Default attributes mirror the API attributes that would allow this access to kube-rbac-proxy
-	attrs := authorizer.AttributesRecord{
+// templatedFields returns the resource attribute fields that run through the
+// rewrite templating, keyed by their configuration name.
+func templatedFields(attrs *ResourceAttributes) map[string]string {
+	return map[string]string{
+		"namespace":   attrs.Namespace,
+		"apiGroup":    attrs.APIGroup,
+		"apiVersion":  attrs.APIVersion,
+		"resource":    attrs.Resource,
+		"subresource": attrs.Subresource,
+		"name":        attrs.Name,
+	}
+}
+
+// nonResourceVerb derives the verb for non-resource SubjectAccessReviews.
+// Non-resource authorization conventionally uses the lowercased HTTP method
+// (get, post, ...) rather than the resource mapping that turns e.g. POST into
+// "create"; OptionsVerb and the non-resource verb overrides apply on top.
+func (n krpAuthorizerAttributesGetter) nonResourceVerb(r *http.Request) string {
+	verb := strings.ToLower(r.Method)
+	if r.Method == "OPTIONS" && n.authzConfig.OptionsVerb != "" {
+		verb = n.authzConfig.OptionsVerb
+	}
+	for method, override := range n.authzConfig.NonResourceVerbOverrides {
+		if strings.ToUpper(method) == r.Method {
+			verb = override
+		}
+	}
+	return verb
+}
+
+// staticRecord builds the attribute record for statically configured resource
+// attributes. An explicit ResourceRequest: false yields a non-resource record
+// for the configured Path (or the request path), decoupled from the resource
+// fields; everything else yields the historical resource record.
+func (n krpAuthorizerAttributesGetter) staticRecord(u user.Info, ra *ResourceAttributes, r *http.Request, apiVerb string) authorizer.AttributesRecord {
+	if ra.ResourceRequest != nil && !*ra.ResourceRequest {
+		path := ra.Path
+		if path == "" {
+			path = r.URL.Path
+		}
+		return authorizer.AttributesRecord{
+			User:            u,
+			Verb:            n.nonResourceVerb(r),
+			ResourceRequest: false,
+			Path:            path,
+		}
+	}
+	return authorizer.AttributesRecord{
 		User:            u,
 		Verb:            apiVerb,
-		Namespace:       "",
-		APIGroup:        "",
-		APIVersion:      "",
-		Resource:        "",
-		Subresource:     "",
-		Name:            "",
-		ResourceRequest: false,
-		Path:            requestPath,
-	}
-
-	if n.authzConfig.ResourceAttributes != nil {
-		attrs = authorizer.AttributesRecord{
+		Namespace:       ra.Namespace,
+		APIGroup:        ra.APIGroup,
+		APIVersion:      ra.APIVersion,
+		Resource:        ra.Resource,
+		Subresource:     ra.Subresource,
+		Name:            ra.Name,
+		ResourceRequest: true,
+	}
+}
+
+// GetRequestAttributes populates authorizer attributes for the requests to kube-rbac-proxy.
+// A return of zero attributes means the request is malformed with respect to
+// the configuration and must be rejected.
+func (n krpAuthorizerAttributesGetter) GetRequestAttributes(u user.Info, r *http.Request) []authorizer.Attributes {
+	verbForMethod := map[string]string{
+		"POST":   "create",
+		"GET":    "get",
+		"HEAD":   "get",
+		"PUT":    "update",
+		"PATCH":  "patch",
+		"DELETE": "delete",
+	}
+	if n.authzConfig.OptionsVerb != "" {
+		verbForMethod["OPTIONS"] = n.authzConfig.OptionsVerb
+	}
+	for method, verb := range n.authzConfig.VerbOverrides {
+		verbForMethod[strings.ToUpper(method)] = verb
+	}
+
+	apiVerb := verbForMethod[r.Method]
+	if apiVerb == "" {
+		apiVerb = n.authzConfig.DefaultVerb
+	}
+
+	var allAttrs []authorizer.Attributes
+
+	if attrs, matched := n.pathRuleAttributes(u, r, apiVerb); matched {
+		return dedupAttributes(attrs)
+	}
+
+	if n.authzConfig.ResourceAttributes == nil {
+		nonResourceVerb := n.nonResourceVerb(r)
+		nonResourcePath := r.URL.Path
+		if nra := n.authzConfig.NonResourceAttributes; nra != nil {
+			// A fixed non-resource configuration decouples the SAR from the
+			// live request path, so every path proxied maps to one well-known
+			// permission.
+			nonResourcePath = nra.Path
+			if nra.Verb != "" {
+				nonResourceVerb = nra.Verb
+			}
+		}
+
+		// Default attributes mirror the API attributes that would allow this access to kube-rbac-proxy
+		allAttrs = append(allAttrs, authorizer.AttributesRecord{
 			User:            u,
-			Verb:            apiVerb,
-			Namespace:       n.authzConfig.ResourceAttributes.Namespace,
-			APIGroup:        n.authzConfig.ResourceAttributes.APIGroup,
-			APIVersion:      n.authzConfig.ResourceAttributes.APIVersion,
-			Resource:        n.authzConfig.ResourceAttributes.Resource,
-			Subresource:     n.authzConfig.ResourceAttributes.Subresource,
-			Name:            n.authzConfig.ResourceAttributes.Name,
+			Verb:            nonResourceVerb,
+			Namespace:       "",
+			APIGroup:        "",
+			APIVersion:      "",
+			Resource:        "",
+			Subresource:     "",
+			Name:            "",
+			ResourceRequest: false,
+			Path:            nonResourcePath,
+		})
+		return allAttrs
+	}
+
+	if n.authzConfig.Rewrites == nil {
+		allAttrs = append(allAttrs, n.staticRecord(u, n.authzConfig.ResourceAttributes, r, apiVerb))
+		return allAttrs
+	}
+
+	params := []string{}
+	verbs := []string{}
+	var captures map[string]string
+	if n.pathRegex != nil {
+		m := n.pathRegex.FindStringSubmatch(r.URL.Path)
+		if m == nil {
+			// A path outside the pattern carries no attribute data; treat it
+			// like a missing capture and reject the request as malformed.
+			return nil
+		}
+		captures = map[string]string{}
+		for i, name := range n.pathRegex.SubexpNames() {
+			if name != "" {
+				captures[name] = m[i]
+			}
+		}
+		params = append(params, m[0])
+		verbs = append(verbs, apiVerb)
+	}
+	if byQuery := n.authzConfig.Rewrites.ByQueryParameter; byQuery != nil && byQuery.Name != "" {
+		if ps, ok := r.URL.Query()[byQuery.Name]; ok {
+			var verbValues []string
+			if byQuery.VerbParameter != "" {
+				verbValues = r.URL.Query()[byQuery.VerbParameter]
+			}
+			for i, p := range ps {
+				if n.queryValueRegex != nil && !n.queryValueRegex.MatchString(p) {
+					// Values outside the configured pattern must not reach
+					// the templates; reject the request as malformed.
+					n.logger.Info(4, "Rejecting request: query parameter value does not match the configured valueRegex", "value", p)
+					return nil
+				}
+				params = append(params, p)
+				// Values without a positional verb keep the uniform verb
+				// derived from the HTTP method.
+				if i < len(verbValues) && verbValues[i] != "" {
+					verbs = append(verbs, verbValues[i])
+				} else {
+					verbs = append(verbs, apiVerb)
+				}
+			}
+		}
+	}
+	if n.authzConfig.Rewrites.ByHTTPHeader != nil && n.authzConfig.Rewrites.ByHTTPHeader.Name != "" {
+		for _, p := range r.Header.Values(n.authzConfig.Rewrites.ByHTTPHeader.Name) {
+			if n.headerValueRegex != nil && !n.headerValueRegex.MatchString(p) {
+				n.logger.Info(4, "Rejecting request: header value does not match the configured valueRegex", "value", p)
+				return nil
+			}
+			params = append(params, p)
+			verbs = append(verbs, apiVerb)
+		}
+	}
+
+	if len(params) == 0 {
+		return nil
+	}
+
+	maxValueLength := n.authzConfig.Rewrites.MaxValueLength
+	if maxValueLength == 0 {
+		maxValueLength = defaultRewriteMaxValueLength
+	}
+	maxOutputLength := n.authzConfig.Rewrites.MaxOutputLength
+	if maxOutputLength == 0 {
+		maxOutputLength = defaultRewriteMaxOutputLength
+	}
+
+	if base := n.authzConfig.BaseResourceAttributes; base != nil {
+		// The static base record goes first so that it is always checked,
+		// even when mode "any" stops at the first allowed rewritten record.
+		allAttrs = append(allAttrs, baseRecordAttributes{n.staticRecord(u, base, r, apiVerb)})
+	}
+
+	for i, param := range params {
+		if len(param) > maxValueLength || len(verbs[i]) > maxValueLength {
+			// Oversized values must not be fed into the templates; reject
+			// the request as malformed.
+			return nil
+		}
+		tmplCtx := TemplateContext{
+			Value:    param,
+			User:     u.GetName(),
+			Groups:   u.GetGroups(),
+			Params:   params,
+			Captures: captures,
+		}
+		var renderErr error
+		render := func(templateString string) string {
+			out, err := n.templateWithValue(templateString, tmplCtx, maxOutputLength)
+			if err != nil && renderErr == nil {
+				renderErr = err
+			}
+			return out
+		}
+		attrs := authorizer.AttributesRecord{
+			User:            u,
+			Verb:            verbs[i],
+			Namespace:       render(n.authzConfig.ResourceAttributes.Namespace),
+			APIGroup:        render(n.authzConfig.ResourceAttributes.APIGroup),
+			APIVersion:      render(n.authzConfig.ResourceAttributes.APIVersion),
+			Resource:        render(n.authzConfig.ResourceAttributes.Resource),
+			Subresource:     render(n.authzConfig.ResourceAttributes.Subresource),
+			Name:            render(n.authzConfig.ResourceAttributes.Name),
 			ResourceRequest: true,
 		}
+		if renderErr != nil {
+			// A failed or over-limit template execution must not silently
+			// authorize with an empty field — an empty Namespace would widen
+			// a namespaced review into a cluster-scoped one. Reject the
+			// request as malformed instead.
+			n.logger.Error("Unable to render subject access review attributes", "err", renderErr.Error())
+			return nil
+		}
+		allAttrs = append(allAttrs, attrs)
+	}
+
+	allAttrs = dedupAttributes(allAttrs)
+
+	for _, attrs := range allAttrs {
+		n.logger.Info(5, "kube-rbac-proxy request attributes", "attrs", fmt.Sprintf("%#v", attrs))
+	}
+
+	return allAttrs
+}
+
+// pathRuleAttributes resolves the configured per-path rules for a request.
+// The second return value reports whether any rule matched; on a match the
+// returned attributes replace the top-level ResourceAttributes entirely.
+func (n krpAuthorizerAttributesGetter) pathRuleAttributes(u user.Info, r *http.Request, apiVerb string) ([]authorizer.Attributes, bool) {
+	var matched []PathAuthorizationRule
+	for _, rule := range n.authzConfig.PathRules {
+		if rule.ResourceAttributes == nil {
+			// Scope-only rules are enforced before authorization and do not
+			// contribute SubjectAccessReview attributes.
+			continue
+		}
+		if pathMatches(r.URL.Path, []string{rule.Path}) {
+			matched = append(matched, rule)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, false
+	}
+
+	switch n.authzConfig.RuleMatchStrategy {
+	case RuleMatchAllMustPass:
+		// Keep every matching rule; the caller requires all resulting
+		// attributes to be allowed.
+	case RuleMatchMostSpecific:
+		best := matched[0]
+		for _, rule := range matched[1:] {
+			if len(strings.TrimSuffix(rule.Path, "*")) > len(strings.TrimSuffix(best.Path, "*")) {
+				best = rule
+			}
+		}
+		matched = []PathAuthorizationRule{best}
+	default:
+		// First-match-wins, in configuration order.
+		matched = matched[:1]
+	}
+
+	allAttrs := make([]authorizer.Attributes, 0, len(matched))
+	for _, rule := range matched {
+		record := n.staticRecord(u, rule.ResourceAttributes, r, apiVerb)
+		if rule.UseLocalSAR {
+			allAttrs = append(allAttrs, localSARAttributes{record})
+			continue
+		}
+		allAttrs = append(allAttrs, record)
+	}
+	return allAttrs, true
+}
+
+// capturedRewriteValues returns the values the configured rewrites capture
+// from the request, in capture order. These double as the tenant identifiers
+// for per-tenant metrics.
+func (n krpAuthorizerAttributesGetter) capturedRewriteValues(r *http.Request) []string {
+	if n.authzConfig.Rewrites == nil {
+		return nil
+	}
+	var values []string
+	if byQuery := n.authzConfig.Rewrites.ByQueryParameter; byQuery != nil && byQuery.Name != "" {
+		values = append(values, r.URL.Query()[byQuery.Name]...)
+	}
+	if byHeader := n.authzConfig.Rewrites.ByHTTPHeader; byHeader != nil && byHeader.Name != "" {
+		values = append(values, r.Header.Values(byHeader.Name)...)
+	}
+	return values
+}
+
+// baseRecordAttributes marks the static base record configured via
+// BaseResourceAttributes. It must be allowed for the request to pass even
+// under rewrite mode "any", and it does not by itself satisfy the
+// at-least-one-allowed requirement of that mode.
+type baseRecordAttributes struct {
+	authorizer.AttributesRecord
+}
+
+// isBaseRecord reports whether an attribute record is the static base record.
+func isBaseRecord(attrs authorizer.Attributes) bool {
+	_, ok := attrs.(baseRecordAttributes)
+	return ok
+}
+
+// dedupAttributes drops identical attribute records, keeping the first
+// occurrence of each in order. Duplicates — e.g. from a repeated capture
+// value in the rewrite fan-out, or overlapping path rules under
+// all-must-pass — cannot change the outcome; they only cost redundant
+// SubjectAccessReviews.
+func dedupAttributes(allAttrs []authorizer.Attributes) []authorizer.Attributes {
+	if len(allAttrs) < 2 {
+		return allAttrs
+	}
+	seen := make(map[string]struct{}, len(allAttrs))
+	deduped := allAttrs[:0]
+	for _, attrs := range allAttrs {
+		key := attributesKey(attrs)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		deduped = append(deduped, attrs)
+	}
+	return deduped
+}
+
+// attributesKey canonicalizes the fields of an attribute record that the
+// SubjectAccessReview carries, for deduplication.
+func attributesKey(attrs authorizer.Attributes) string {
+	return strings.Join([]string{
+		attrs.GetVerb(),
+		attrs.GetNamespace(),
+		attrs.GetAPIGroup(),
+		attrs.GetAPIVersion(),
+		attrs.GetResource(),
+		attrs.GetSubresource(),
+		attrs.GetName(),
+		strconv.FormatBool(attrs.IsResourceRequest()),
+		strconv.FormatBool(isLocalSAR(attrs)),
+		strconv.FormatBool(isBaseRecord(attrs)),
+		attrs.GetPath(),
+	}, "\x00")
+}
+
+// TemplateContext is the data available to the rewrite templates in
+// ResourceAttributes.
+type TemplateContext struct {
+	// Value is the captured value the current attribute record is derived
+	// from, matching the historical single-value template context.
+	Value string
+	// User is the authenticated user's name.
+	User string
+	// Groups are the authenticated user's groups.
+	Groups []string
+	// Params are all values the configured rewrites captured from the
+	// request, in capture order, so a template can combine captures from
+	// different sources.
+	Params []string
+	// Captures holds the named capture groups of the byPathRegex rewrite,
+	// keyed by group name; nil when no path rewrite is configured.
+	Captures map[string]string
+}
+
+// templateWithValue renders the parsed template for templateString with ctx,
+// capping the output at maxOutputLength bytes. Execution failures and
+// over-limit output are returned as errors rather than collapsing the field
+// to an empty string, which would silently broaden the resulting review.
+func (n krpAuthorizerAttributesGetter) templateWithValue(templateString string, ctx TemplateContext, maxOutputLength int) (string, error) {
+	tmpl, ok := n.templates[templateString]
+	if !ok {
+		return "", nil
+	}
+	out := &limitWriter{buf: bytes.NewBuffer(nil), limit: maxOutputLength}
+	if err := tmpl.Execute(out, ctx); err != nil {
+		return "", err
+	}
+	return out.buf.String(), nil
+}
+
+var errTemplateOutputTooLarge = errors.New("template output exceeds the configured limit")
+
+// limitWriter caps how many bytes a template execution may produce.
+type limitWriter struct {
+	buf   *bytes.Buffer
+	limit int
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.limit {
+		return 0, errTemplateOutputTooLarge
+	}
+	return w.buf.Write(p)
+}
+
+// withExtraValue returns a copy of the user with one extra entry added,
+// leaving the original untouched.
+func withExtraValue(u user.Info, key string, values []string) user.Info {
+	extra := map[string][]string{}
+	for k, v := range u.GetExtra() {
+		extra[k] = v
+	}
+	extra[key] = values
+
+	return &user.DefaultInfo{
+		Name:   u.GetName(),
+		UID:    u.GetUID(),
+		Groups: u.GetGroups(),
+		Extra:  extra,
+	}
+}
+
+// withAugmentedGroups returns a copy of the user with the given groups
+// appended, skipping any the user already has. The original stays untouched
+// so that a cached authenticator result is never mutated.
+func withAugmentedGroups(u user.Info, groups []string) user.Info {
+	existing := make(map[string]struct{}, len(u.GetGroups()))
+	merged := make([]string, 0, len(u.GetGroups())+len(groups))
+	for _, g := range u.GetGroups() {
+		existing[g] = struct{}{}
+		merged = append(merged, g)
+	}
+	for _, g := range groups {
+		if _, ok := existing[g]; ok {
+			continue
+		}
+		merged = append(merged, g)
+	}
+
+	return &user.DefaultInfo{
+		Name:   u.GetName(),
+		UID:    u.GetUID(),
+		Groups: merged,
+		Extra:  u.GetExtra(),
+	}
+}
+
+// withSelectorExtra returns a copy of the user carrying the request's field
+// and label selectors in its extra, so they reach the authorizer through the
+// SubjectAccessReview. The user is returned unchanged when the request has no
+// selectors.
+func withSelectorExtra(u user.Info, r *http.Request) user.Info {
+	query := r.URL.Query()
+	fieldSelector := query.Get("fieldSelector")
+	labelSelector := query.Get("labelSelector")
+	if fieldSelector == "" && labelSelector == "" {
+		return u
+	}
+
+	extra := map[string][]string{}
+	for k, v := range u.GetExtra() {
+		extra[k] = v
+	}
+	if fieldSelector != "" {
+		extra["authorization.kubernetes.io/field-selector"] = []string{fieldSelector}
+	}
+	if labelSelector != "" {
+		extra["authorization.kubernetes.io/label-selector"] = []string{labelSelector}
+	}
+
+	return &user.DefaultInfo{
+		Name:   u.GetName(),
+		UID:    u.GetUID(),
+		Groups: u.GetGroups(),
+		Extra:  extra,
+	}
+}
+
+// truncateReason caps the reason string returned by an authorizer so that a
+// misbehaving policy engine cannot inflate log volume with an arbitrarily
+// large response. A non-positive limit applies the default.
+func truncateReason(reason string, limit int) string {
+	if limit <= 0 {
+		limit = defaultMaxReasonLength
+	}
+	if len(reason) <= limit {
+		return reason
+	}
+	return reason[:limit] + "...(truncated)"
+}
+
+func isAnonymousUser(u user.Info) bool {
+	if u.GetName() == user.Anonymous {
+		return true
+	}
+	for _, g := range u.GetGroups() {
+		if g == user.AllUnauthenticated {
+			return true
+		}
+	}
+	return false
+}
+
+func namespaceAllowed(namespace string, allowed []string) bool {
+	if namespace == "" {
+		return true
+	}
+	for _, ns := range allowed {
+		if namespace == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// unauthorized answers the request with a 401 carrying the configured
+// WWW-Authenticate challenge, so clients know how to authenticate. It always
+// returns false, allowing callers to `return h.unauthorized(w)`.
+func (h *kubeRBACProxyAuth) unauthorized(w http.ResponseWriter) bool {
+	challenge := h.Config.Authentication.Challenge
+	if challenge == "" {
+		challenge = "Bearer"
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	h.writeError(w, http.StatusUnauthorized)
+	return false
+}
+
+// writeError writes a client-facing error response for the given status.
+// Detail about the denied action belongs in the logs; the body carries only
+// the generic status text, a configured override, or a structured JSON
+// error, never the user, verb or resource involved.
+func (h *kubeRBACProxyAuth) writeError(w http.ResponseWriter, status int) {
+	if cfg := h.Config.ErrorBodies; cfg != nil {
+		contentType := "text/plain; charset=utf-8"
+		if cfg.Mode == ErrorBodyJSON {
+			contentType = "application/json"
+		}
+
+		if body, ok := cfg.Overrides[strconv.Itoa(status)]; ok {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(status)
+			fmt.Fprintln(w, body)
+			return
+		}
+
+		if cfg.Mode == ErrorBodyJSON {
+			body, err := json.Marshal(struct {
+				Error  string `json:"error"`
+				Status int    `json:"status"`
+			}{Error: http.StatusText(status), Status: status})
+			if err == nil {
+				w.Header().Set("Content-Type", contentType)
+				w.Header().Set("X-Content-Type-Options", "nosniff")
+				w.WriteHeader(status)
+				w.Write(body)
+				return
+			}
+		}
 	}
 
-	glog.V(5).Infof("kube-rbac-proxy request attributes: attrs=%#v", attrs)
+	http.Error(w, http.StatusText(status), status)
+}
+
+// requiredScopesForPath collects the scopes required by every path rule
+// matching the request path. When several rules match, their scope
+// requirements accumulate.
+func (h *kubeRBACProxyAuth) requiredScopesForPath(requestPath string) []string {
+	if h.Config.Authorization == nil {
+		return nil
+	}
+	var required []string
+	for _, rule := range h.Config.Authorization.PathRules {
+		if len(rule.RequiredScopes) > 0 && pathMatches(requestPath, []string{rule.Path}) {
+			required = append(required, rule.RequiredScopes...)
+		}
+	}
+	return required
+}
+
+// methodAllowed reports whether the request method is in the configured
+// allowed methods list; matching is case-insensitive, so a configured "get"
+// covers the canonical "GET".
+func methodAllowed(method string, allowed []string) bool {
+	for _, m := range allowed {
+		if strings.EqualFold(method, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// missingScopes returns the required scopes the token's scopes do not cover.
+func missingScopes(scopes, required []string) []string {
+	have := make(map[string]struct{}, len(scopes))
+	for _, s := range scopes {
+		have[s] = struct{}{}
+	}
+	var missing []string
+	for _, s := range required {
+		if _, ok := have[s]; !ok {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
 
-	return attrs
+func (h *kubeRBACProxyAuth) skipAuthorizationForUserAgent(userAgent string) bool {
+	if h.Config.Authorization == nil || userAgent == "" {
+		return false
+	}
+	for _, allowed := range h.Config.Authorization.SkipAuthorizationForUserAgents {
+		if userAgent == allowed {
+			return true
+		}
+	}
+	return false
 }
 
 type AuthHandler interface {
 	Handle(w http.ResponseWriter, req *http.Request) bool
 }
 
+// Middleware wraps next with the handler's authentication and authorization:
+// next is only invoked when Handle admits the request — with the identity
+// headers already injected, when configured — and denied requests have their
+// response written by Handle. It makes the handler composable with the
+// standard library and common routers without every caller re-implementing
+// the Handle boolean check.
+func (h *kubeRBACProxyAuth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !h.Handle(w, req) {
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
 // Handle authenticates the client and authorizes the request.
 // If the authn fails, a 401 error is returned. If the authz fails, a 403 error is returned
 func (h *kubeRBACProxyAuth) Handle(w http.ResponseWriter, req *http.Request) bool {
-	// Authenticate
-	u, ok, err := h.AuthenticateRequest(req)
-	if err != nil {
-		glog.Errorf("Unable to authenticate the request due to an error: %v", err)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if len(h.Config.AllowedMethods) > 0 && !methodAllowed(req.Method, h.Config.AllowedMethods) {
+		h.logger.Info(2, "Rejecting request: method is not in the allowed methods list", "method", req.Method, "path", req.URL.Path)
+		w.Header().Set("Allow", strings.Join(h.Config.AllowedMethods, ", "))
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return false
 	}
-	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+
+	// Drop any client-supplied copies of the identity headers up front,
+	// whether or not injection is enabled. The upstream must never see a
+	// forged identity under the configured header names, including the
+	// extra-field headers under the configured prefix.
+	StripIdentityHeaders(req.Header, h.Config.Authentication.Header)
+
+	if pathMatches(req.URL.Path, h.Config.IgnorePaths) {
+		// Ignored paths (e.g. the upstream's own /healthz) are proxied
+		// through without authentication or authorization. pathMatches
+		// normalizes the request path first, so "/healthz/../secure" does
+		// not slip through a /healthz pattern. The identity headers were
+		// already stripped above, so no forged identity reaches the
+		// upstream either.
+		h.logger.Info(4, "Skipping auth for ignored path", "path", req.URL.Path)
+		return true
+	}
+
+	if x509Config := h.Config.Authentication.X509; x509Config != nil &&
+		req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		if x509Config.EnforceKeyUsage {
+			if err := validateClientCertUsage(req.TLS.PeerCertificates[0]); err != nil {
+				h.logger.Info(2, "Rejecting request", "reason", err.Error())
+				return h.unauthorized(w)
+			}
+		}
+		if x509Config.MinRSAKeySize > 0 || x509Config.RejectWeakSignatureAlgorithms {
+			if err := validateClientCertStrength(req.TLS.PeerCertificates[0], x509Config); err != nil {
+				h.logger.Info(2, "Rejecting request", "reason", err.Error())
+				return h.unauthorized(w)
+			}
+		}
+	}
+
+	if h.backendLimiter != nil && !h.backendLimiter.TryAccept() {
+		h.logger.Info(2, "Shedding request: backend rate limit exceeded", "path", req.URL.Path)
+		// Shed instead of queuing unboundedly; the Retry-After hint is
+		// derived from the configured rate when known.
+		retryAfter := 1
+		if rl := h.Config.BackendRateLimit; rl != nil && rl.QPS > 0 && rl.QPS < 1 {
+			retryAfter = int(1/rl.QPS + 0.5)
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
 		return false
 	}
 
-	// Get authorization attributes
-	attrs := h.GetRequestAttributes(u, req)
+	backendTimeout := h.Config.Timeout
+	if backendTimeout == 0 {
+		backendTimeout = defaultAuthTimeout
+	}
+
+	// The bearer-token authenticator deletes the Authorization header once
+	// it has authenticated the request, so anything that needs the presented
+	// credential afterwards has to capture it now.
+	originalAuthorization := req.Header.Get("Authorization")
+	presentedToken := bearerToken(req)
 
-	// Authorize
-	authorized, _, err := h.Authorize(attrs)
+	// Authenticate
+	var (
+		u   user.Info
+		ok  bool
+		err error
+	)
+	authnStart := time.Now()
+	if backendTimeout > 0 {
+		if !callWithTimeout(backendTimeout, func() { u, ok, err = h.AuthenticateRequest(req) }) {
+			h.logger.Error("Authentication timed out", "path", req.URL.Path, "timeout", backendTimeout)
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return false
+		}
+	} else {
+		u, ok, err = h.AuthenticateRequest(req)
+	}
+	authnDuration := time.Since(authnStart)
 	if err != nil {
-		msg := fmt.Sprintf("Authorization error (user=%s, verb=%s, resource=%s, subresource=%s)", u.GetName(), attrs.GetVerb(), attrs.GetResource(), attrs.GetSubresource())
-		glog.Errorf(msg, err)
-		http.Error(w, msg, http.StatusInternalServerError)
-		return false
+		h.logger.Error("Unable to authenticate the request due to an error", "err", err.Error())
+		return h.unauthorized(w)
 	}
-	if authorized != authorizer.DecisionAllow {
-		msg := fmt.Sprintf("Forbidden (user=%s, verb=%s, resource=%s, subresource=%s)", u.GetName(), attrs.GetVerb(), attrs.GetResource(), attrs.GetSubresource())
-		glog.V(2).Info(msg)
-		http.Error(w, msg, http.StatusForbidden)
-		return false
+	if !ok {
+		return h.unauthorized(w)
+	}
+
+	if x509Config := h.Config.Authentication.X509; x509Config != nil && len(x509Config.ExtraFields) > 0 &&
+		req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		u = withClientCertExtra(u, req.TLS.PeerCertificates[0], x509Config.ExtraFields)
+	}
+
+	if authn := h.Config.Authentication; len(authn.StaticGroups) > 0 || len(authn.CNGroups) > 0 {
+		groups := authn.StaticGroups
+		if group, ok := authn.CNGroups[u.GetName()]; ok {
+			groups = append(copyStrings(groups), group)
+		}
+		if len(groups) > 0 {
+			u = withAugmentedGroups(u, groups)
+		}
+	}
+
+	if h.Config.Authorization.IncludeSelectors {
+		u = withSelectorExtra(u, req)
+	}
+
+	if h.proxyIdentity != "" {
+		u = withExtraValue(u, "kube-rbac-proxy/identity", []string{h.proxyIdentity})
+	}
+
+	if isAnonymousUser(u) && !pathMatches(req.URL.Path, h.Config.Authentication.AnonymousPaths) {
+		h.logger.Info(2, "Rejecting request: identity resolved to the anonymous user", "path", req.URL.Path)
+		return h.unauthorized(w)
+	}
+
+	if required := h.requiredScopesForPath(req.URL.Path); len(required) > 0 {
+		scopes, _ := tokenScopes(presentedToken)
+		if missing := missingScopes(scopes, required); len(missing) > 0 {
+			h.logger.Info(2, "Forbidden: token lacks required scopes", "decision", "deny", "user", u.GetName(), "path", req.URL.Path, "missingScopes", missing)
+			h.writeError(w, http.StatusForbidden)
+			return false
+		}
+	}
+
+	var authzDuration time.Duration
+
+	if h.skipAuthorizationForUserAgent(req.UserAgent()) {
+		// Allowlisted internal agents skip the SubjectAccessReview once they
+		// are authenticated; this is always logged for auditability.
+		h.logger.Info(2, "Skipping authorization for allowlisted user agent", "userAgent", req.UserAgent(), "user", u.GetName(), "path", req.URL.Path)
+	} else {
+		authzStart := time.Now()
+
+		// Get authorization attributes
+		allAttrs := h.authorizerAttributesGetter.GetRequestAttributes(u, req)
+		if len(allAttrs) == 0 {
+			msg := "Bad Request. The request or configuration is malformed."
+			h.logger.Info(2, msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return false
+		}
+
+		for _, attrs := range allAttrs {
+			// An empty verb always fails authorization, so reject it with an
+			// actionable error instead of issuing a doomed SubjectAccessReview.
+			if attrs.GetVerb() == "" {
+				msg := fmt.Sprintf("Method Not Allowed. The HTTP method %q does not map to an authorization verb and no default verb is configured.", req.Method)
+				h.logger.Info(2, msg)
+				http.Error(w, msg, http.StatusMethodNotAllowed)
+				return false
+			}
+
+			// Namespaces derived from request data are constrained to the
+			// configured allowlist so that clients cannot probe arbitrary
+			// namespaces through the rewrite.
+			if h.Config.Authorization.Rewrites != nil && len(h.Config.Authorization.AllowedNamespaces) > 0 &&
+				!namespaceAllowed(attrs.GetNamespace(), h.Config.Authorization.AllowedNamespaces) {
+				h.logger.Info(2, "Forbidden: namespace is not in the configured namespace allowlist", "decision", "deny", "user", u.GetName(), "namespace", attrs.GetNamespace())
+				h.writeError(w, http.StatusForbidden)
+				return false
+			}
+		}
+
+		authorize := h.Authorize
+		if h.selfAuthorizer != nil {
+			// The authenticator may already have consumed the Authorization
+			// header, so the token captured before authentication is used.
+			token := presentedToken
+			if token == "" {
+				h.logger.Info(2, "Forbidden: self subject access review authorization requires a bearer token", "decision", "deny", "user", u.GetName())
+				h.writeError(w, http.StatusForbidden)
+				return false
+			}
+			authorize = func(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+				return h.selfAuthorizer.AuthorizeWithToken(token, attrs)
+			}
+		}
+
+		// Path rules may ask for the namespace-scoped LocalSubjectAccessReview
+		// variant per attribute record; those records are dispatched to the
+		// local authorizer, everything else keeps the authorizer chosen above.
+		baseAuthorize := authorize
+		authorize = func(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+			if isLocalSAR(attrs) {
+				if h.localSARAuthorizer == nil {
+					return authorizer.DecisionNoOpinion, "", errors.New("local SubjectAccessReview authorization requires a Kubernetes client")
+				}
+				return h.localSARAuthorizer.Authorize(attrs)
+			}
+			return baseAuthorize(attrs)
+		}
+
+		if backendTimeout > 0 {
+			inner := authorize
+			authorize = func(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+				var (
+					decision authorizer.Decision
+					reason   string
+					err      error
+				)
+				if !callWithTimeout(backendTimeout, func() { decision, reason, err = inner(attrs) }) {
+					return authorizer.DecisionNoOpinion, "", fmt.Errorf("authorization timed out after %v", backendTimeout)
+				}
+				return decision, reason, err
+			}
+		}
+
+		// Memoize decisions within this request, keyed on the canonical
+		// attribute tuple. dedupAttributes already drops identical records,
+		// but the memo guarantees at-most-once authorization per tuple even
+		// on the first, uncached request, independent of the authorizer's
+		// own TTL cache.
+		type authorizeOutcome struct {
+			decision authorizer.Decision
+			reason   string
+			err      error
+		}
+		outcomes := make(map[string]authorizeOutcome, len(allAttrs))
+		memoInner := authorize
+		authorize = func(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+			key := attributesKey(attrs)
+			if out, ok := outcomes[key]; ok {
+				return out.decision, out.reason, out.err
+			}
+			decision, reason, err := memoInner(attrs)
+			outcomes[key] = authorizeOutcome{decision: decision, reason: reason, err: err}
+			return decision, reason, err
+		}
+
+		// With per-tenant metrics enabled, the request-level outcome is
+		// additionally counted for every tenant value the rewrites captured.
+		recordTenantDecision := func(decision string) {
+			if !h.Config.Authorization.TenantMetrics {
+				return
+			}
+			for _, tenant := range h.authorizerAttributesGetter.capturedRewriteValues(req) {
+				metrics.RecordTenantDecision(tenant, decision)
+			}
+		}
+
+		// Under "any" mode a single allowed record authorizes the request;
+		// the default requires every record to be allowed.
+		anyMode := h.Config.Authorization.Rewrites != nil &&
+			h.Config.Authorization.Rewrites.ByQueryParameter != nil &&
+			h.Config.Authorization.Rewrites.ByQueryParameter.Mode == RewriteModeAny
+
+		// With an authorize-verbs list configured, records mapping to a verb
+		// outside the list need authentication only.
+		var authorizeVerbs map[string]struct{}
+		if verbs := h.Config.Authorization.AuthorizeVerbs; len(verbs) > 0 {
+			authorizeVerbs = make(map[string]struct{}, len(verbs))
+			for _, verb := range verbs {
+				authorizeVerbs[verb] = struct{}{}
+			}
+		}
+
+		anyAllowed := false
+		for _, attrs := range allAttrs {
+			if authorizeVerbs != nil {
+				if _, ok := authorizeVerbs[attrs.GetVerb()]; !ok {
+					h.logger.Info(4, "Skipping authorization for verb outside the authorize-verbs list", "user", u.GetName(), "verb", attrs.GetVerb())
+					metrics.RecordAuthorizationDecision(req.Method, attrs.GetVerb(), "skip")
+					if anyMode && !isBaseRecord(attrs) {
+						anyAllowed = true
+						break
+					}
+					continue
+				}
+			}
+
+			// Authorize
+			authorized, reason, err := authorize(attrs)
+			if err != nil {
+				metrics.RecordAuthorizationDecision(req.Method, attrs.GetVerb(), "error")
+				recordTenantDecision("error")
+				h.logger.Error("Authorization error", "decision", "error", "user", u.GetName(), "method", req.Method, "verb", attrs.GetVerb(), "resource", attrs.GetResource(), "subresource", attrs.GetSubresource(), "err", err.Error())
+				// The denied action and the underlying error stay in the
+				// logs; the response body must not leak them to the client.
+				h.writeError(w, http.StatusInternalServerError)
+				return false
+			}
+			if authorized != authorizer.DecisionAllow {
+				metrics.RecordAuthorizationDecision(req.Method, attrs.GetVerb(), "deny")
+				kvs := []interface{}{"decision", "deny", "user", u.GetName(), "method", req.Method, "verb", attrs.GetVerb(), "resource", attrs.GetResource(), "subresource", attrs.GetSubresource()}
+				if reason = truncateReason(reason, h.Config.Authorization.MaxReasonLength); reason != "" {
+					kvs = append(kvs, "reason", reason)
+				}
+				h.logger.Info(2, "Forbidden", kvs...)
+				if anyMode && !isBaseRecord(attrs) {
+					// A denied rewritten record is not final here; keep
+					// checking the remaining ones. A denied base record is
+					// always final.
+					continue
+				}
+				recordTenantDecision("deny")
+				// msg above is logged only; the client sees a generic body.
+				h.writeError(w, http.StatusForbidden)
+				return false
+			}
+			metrics.RecordAuthorizationDecision(req.Method, attrs.GetVerb(), "allow")
+			if anyMode && !isBaseRecord(attrs) {
+				// The base record sits first in allAttrs and was already
+				// checked, so stopping at the first allowed rewritten record
+				// cannot skip it.
+				anyAllowed = true
+				break
+			}
+		}
+		if anyMode && !anyAllowed {
+			recordTenantDecision("deny")
+			h.logger.Info(2, "Forbidden: no attribute record was allowed", "decision", "deny", "user", u.GetName(), "method", req.Method)
+			h.writeError(w, http.StatusForbidden)
+			return false
+		}
+		recordTenantDecision("allow")
+
+		authzDuration = time.Since(authzStart)
+	}
+
+	// Surface the resolved identity on the request context, so downstream
+	// handlers (Middleware's next, response logging, embedder audit hooks)
+	// can retrieve it via UserFrom without re-parsing headers. The presented
+	// token's expiry travels along for callers bounding long-lived
+	// connections, since the Authorization header may already be gone.
+	ctx := WithUser(req.Context(), u)
+	if exp, ok := tokenExpiry(presentedToken); ok {
+		ctx = WithTokenExpiry(ctx, exp)
+	}
+	*req = *req.WithContext(ctx)
+
+	if h.Config.ServerTiming {
+		// The upstream round trip only starts after this handler returns, so
+		// its duration cannot be part of the header; authn and authz cover the
+		// proxy's own contribution to request latency.
+		w.Header().Set("Server-Timing", fmt.Sprintf("authn;dur=%.1f, authz;dur=%.1f",
+			float64(authnDuration)/float64(time.Millisecond), float64(authzDuration)/float64(time.Millisecond)))
+	}
+
+	if h.Config.Authentication.PassthroughToken {
+		// Forward the client's credential only when the authentication can be
+		// attributed to it: a bearer token present without a client
+		// certificate. A request carrying both may have authenticated via the
+		// certificate, so the header is stripped rather than forwarding a
+		// token the proxy never validated. The authenticator may have
+		// consumed the header, so it is restored from the captured value.
+		if presentedToken != "" && (req.TLS == nil || len(req.TLS.PeerCertificates) == 0) {
+			req.Header.Set("Authorization", originalAuthorization)
+		} else {
+			req.Header.Del("Authorization")
+		}
 	}
 
 	if h.Config.Authentication.Header.Enabled {
 		// Seemingly well-known headers to tell the upstream about user's identity
 		// so that the upstream can achieve the original goal of delegating RBAC authn/authz to kube-rbac-proxy
 		headerCfg := h.Config.Authentication.Header
-		req.Header.Set(headerCfg.UserFieldName, u.GetName())
-		req.Header.Set(headerCfg.GroupsFieldName, strings.Join(u.GetGroups(), headerCfg.GroupSeparator))
+
+		// Identity values are attacker-influenced and must not be able to
+		// inject headers through embedded CR/LF.
+		name, nameOK := encodeHeaderValue(u.GetName(), headerCfg.Encoding)
+		groups := make([]string, 0, len(u.GetGroups()))
+		groupsOK := true
+		for _, g := range u.GetGroups() {
+			encoded, ok := encodeHeaderValue(g, headerCfg.Encoding)
+			groupsOK = groupsOK && ok
+			groups = append(groups, encoded)
+		}
+		if !nameOK || !groupsOK {
+			h.logger.Info(2, "Rejecting request: identity contains control characters", "user", u.GetName())
+			h.writeError(w, http.StatusForbidden)
+			return false
+		}
+
+		req.Header.Set(headerCfg.UserFieldName, name)
+		if headerCfg.GroupsAsRepeatedHeader {
+			// The header was already deleted at the top of Handle, so Add
+			// only accumulates this request's groups; a user without groups
+			// sends no groups header at all.
+			for _, g := range groups {
+				req.Header.Add(headerCfg.GroupsFieldName, g)
+			}
+		} else {
+			req.Header.Set(headerCfg.GroupsFieldName, strings.Join(groups, headerCfg.GroupSeparator))
+		}
+
+		if headerCfg.ExtraFieldPrefix != "" {
+			for key, values := range u.GetExtra() {
+				headerName := headerCfg.ExtraFieldPrefix + sanitizeHeaderName(key)
+				if headerName == headerCfg.ExtraFieldPrefix || len(values) == 0 {
+					continue
+				}
+				encoded := make([]string, 0, len(values))
+				valuesOK := true
+				for _, v := range values {
+					e, ok := encodeHeaderValue(v, headerCfg.Encoding)
+					valuesOK = valuesOK && ok
+					encoded = append(encoded, e)
+				}
+				if !valuesOK {
+					h.logger.Info(2, "Rejecting request: extra field contains control characters", "extraField", key, "user", u.GetName())
+					h.writeError(w, http.StatusForbidden)
+					return false
+				}
+				req.Header.Set(headerName, strings.Join(encoded, headerCfg.GroupSeparator))
+			}
+		}
 	}
 
 	return true
@@ -0,0 +1,1388 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"errors"
+	"github.com/brancz/kube-rbac-proxy/metrics"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	authenticationv1beta1 "k8s.io/api/authentication/v1beta1"
+	authorizationv1beta1 "k8s.io/api/authorization/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// testConfig returns the minimal configuration Handle expects, mirroring the
+// defaults main wires up.
+func testConfig() *AuthConfig {
+	return &AuthConfig{
+		Authentication: &AuthnConfig{
+			Header: &AuthnHeaderConfig{
+				UserFieldName:   "x-remote-user",
+				GroupsFieldName: "x-remote-groups",
+				GroupSeparator:  "|",
+			},
+		},
+		Authorization: &AuthzConfig{},
+	}
+}
+
+// staticAuthenticator yields a fixed authentication result for every request.
+type staticAuthenticator struct {
+	u   user.Info
+	ok  bool
+	err error
+}
+
+func (a *staticAuthenticator) AuthenticateRequest(req *http.Request) (user.Info, bool, error) {
+	return a.u, a.ok, a.err
+}
+
+func authenticateAs(name string, groups ...string) *staticAuthenticator {
+	return &staticAuthenticator{u: &user.DefaultInfo{Name: name, Groups: groups}, ok: true}
+}
+
+// headerConsumingAuthenticator wraps a delegate and deletes the Authorization
+// header on success, mimicking the production bearer-token authenticator.
+type headerConsumingAuthenticator struct {
+	delegate authenticator.Request
+}
+
+func (a *headerConsumingAuthenticator) AuthenticateRequest(req *http.Request) (user.Info, bool, error) {
+	u, ok, err := a.delegate.AuthenticateRequest(req)
+	if ok && err == nil {
+		req.Header.Del("Authorization")
+	}
+	return u, ok, err
+}
+
+// recordingAuthorizer captures the attribute records it is asked to decide on
+// and answers with decide, or allows everything when decide is nil.
+type recordingAuthorizer struct {
+	mu     sync.Mutex
+	attrs  []authorizer.Attributes
+	decide func(authorizer.Attributes) (authorizer.Decision, string, error)
+}
+
+func (a *recordingAuthorizer) Authorize(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	a.mu.Lock()
+	a.attrs = append(a.attrs, attrs)
+	a.mu.Unlock()
+	if a.decide != nil {
+		return a.decide(attrs)
+	}
+	return authorizer.DecisionAllow, "", nil
+}
+
+func (a *recordingAuthorizer) recorded() []authorizer.Attributes {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]authorizer.Attributes{}, a.attrs...)
+}
+
+func TestRewriteRejectsOversizedCapturedValues(t *testing.T) {
+	g := newKubeRBACProxyAuthorizerAttributesGetter(&AuthzConfig{
+		Rewrites: &SubjectAccessReviewRewrites{
+			ByQueryParameter: &QueryParameterRewriteConfig{Name: "namespace"},
+			MaxValueLength:   8,
+		},
+		ResourceAttributes: &ResourceAttributes{
+			Namespace: "{{ .Value }}",
+			Resource:  "pods",
+		},
+	})
+	u := &user.DefaultInfo{Name: "jane"}
+
+	req := httptest.NewRequest(http.MethodGet, "/api?namespace=team-a", nil)
+	attrs := g.GetRequestAttributes(u, req)
+	if len(attrs) != 1 || attrs[0].GetNamespace() != "team-a" {
+		t.Fatalf("expected one record for namespace team-a, got %v", attrs)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api?namespace=namespace-far-beyond-the-limit", nil)
+	if attrs := g.GetRequestAttributes(u, req); attrs != nil {
+		t.Errorf("expected an oversized captured value to be rejected as malformed, got %v", attrs)
+	}
+}
+
+func TestTemplateOutputBeyondLimitRejectsTheRequest(t *testing.T) {
+	g := newKubeRBACProxyAuthorizerAttributesGetter(&AuthzConfig{
+		Rewrites: &SubjectAccessReviewRewrites{
+			ByQueryParameter: &QueryParameterRewriteConfig{Name: "namespace"},
+			MaxOutputLength:  16,
+		},
+		ResourceAttributes: &ResourceAttributes{
+			Namespace: "{{ .Value }}{{ .Value }}{{ .Value }}",
+			Resource:  "pods",
+		},
+	})
+	u := &user.DefaultInfo{Name: "jane"}
+
+	// An over-limit template output must not collapse to an empty namespace,
+	// which would widen the review to cluster scope; the request is rejected
+	// as malformed instead.
+	req := httptest.NewRequest(http.MethodGet, "/api?namespace=tenant-x", nil)
+	if attrs := g.GetRequestAttributes(u, req); attrs != nil {
+		t.Errorf("expected over-limit template output to be rejected as malformed, got %v", attrs)
+	}
+
+	// Output inside the limit renders as usual.
+	req = httptest.NewRequest(http.MethodGet, "/api?namespace=ab", nil)
+	attrs := g.GetRequestAttributes(u, req)
+	if len(attrs) != 1 || attrs[0].GetNamespace() != "ababab" {
+		t.Fatalf("expected one record for namespace ababab, got %v", attrs)
+	}
+}
+
+// allowAllKubeClient returns a fake clientset whose TokenReviews authenticate
+// every token as tokenUser and whose SubjectAccessReviews allow everything,
+// for tests exercising the full BuildAuthHandler path.
+func allowAllKubeClient(tokenUser string) *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, &authenticationv1beta1.TokenReview{
+			Status: authenticationv1beta1.TokenReviewStatus{
+				Authenticated: true,
+				User:          authenticationv1beta1.UserInfo{Username: tokenUser},
+			},
+		}, nil
+	})
+	client.PrependReactor("create", "subjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, &authorizationv1beta1.SubjectAccessReview{
+			Status: authorizationv1beta1.SubjectAccessReviewStatus{Allowed: true},
+		}, nil
+	})
+	return client
+}
+
+func TestSkipAuthorizationForUserAgents(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization.SkipAuthorizationForUserAgents = []string{"kube-probe/1.29"}
+	authz := &recordingAuthorizer{
+		decide: func(authorizer.Attributes) (authorizer.Decision, string, error) {
+			return authorizer.DecisionDeny, "denied by test", nil
+		},
+	}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	req.Header.Set("User-Agent", "kube-probe/1.29")
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, req) {
+		t.Errorf("expected the allowlisted user agent to bypass authorization, got status %d", rec.Code)
+	}
+	if got := authz.recorded(); len(got) != 0 {
+		t.Errorf("expected no authorizer calls for the allowlisted user agent, got %d", len(got))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	req.Header.Set("User-Agent", "curl/8.0")
+	rec = httptest.NewRecorder()
+	if h.Handle(rec, req) {
+		t.Error("expected other user agents to still go through authorization")
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+	if got := authz.recorded(); len(got) == 0 {
+		t.Error("expected the authorizer to be consulted for other user agents")
+	}
+}
+
+func TestHandleRejectsUnmappableMethodsWithoutDefaultVerb(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization.ResourceAttributes = &ResourceAttributes{Resource: "pods"}
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+
+	req := httptest.NewRequest("PROPFIND", "/api/v1/pods", nil)
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, req) {
+		t.Error("expected a method without a verb mapping to be rejected")
+	}
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+	if got := authz.recorded(); len(got) != 0 {
+		t.Errorf("expected no SubjectAccessReview for an empty verb, got %d", len(got))
+	}
+
+	cfg.Authorization.DefaultVerb = "get"
+	h = newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+	req = httptest.NewRequest("PROPFIND", "/api/v1/pods", nil)
+	rec = httptest.NewRecorder()
+	if !h.Handle(rec, req) {
+		t.Errorf("expected the default verb to admit the method, got status %d", rec.Code)
+	}
+	got := authz.recorded()
+	if len(got) != 1 || got[0].GetVerb() != "get" {
+		t.Errorf("expected one authorization with the default verb, got %v", got)
+	}
+}
+
+func TestHandleEnforcesNamespaceAllowlist(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization = &AuthzConfig{
+		Rewrites: &SubjectAccessReviewRewrites{
+			ByQueryParameter: &QueryParameterRewriteConfig{Name: "namespace"},
+		},
+		ResourceAttributes: &ResourceAttributes{
+			Namespace: "{{ .Value }}",
+			Resource:  "pods",
+		},
+		AllowedNamespaces: []string{"team-a"},
+	}
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/api?namespace=team-a", nil)
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, req) {
+		t.Errorf("expected an allowlisted namespace to proceed, got status %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api?namespace=team-b", nil)
+	rec = httptest.NewRecorder()
+	if h.Handle(rec, req) {
+		t.Error("expected a namespace outside the allowlist to be rejected")
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+	for _, attrs := range authz.recorded() {
+		if attrs.GetNamespace() == "team-b" {
+			t.Error("expected no SubjectAccessReview for a namespace outside the allowlist")
+		}
+	}
+}
+
+func TestHandleRejectsAnonymousIdentities(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authentication.AnonymousPaths = []string{"/healthz"}
+	authz := &recordingAuthorizer{}
+
+	for _, tc := range []struct {
+		name string
+		u    user.Info
+	}{
+		{name: "anonymous user", u: &user.DefaultInfo{Name: user.Anonymous}},
+		{name: "unauthenticated group", u: &user.DefaultInfo{Name: "someone", Groups: []string{user.AllUnauthenticated}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newKubeRBACProxyAuth(&staticAuthenticator{u: tc.u, ok: true}, authz, cfg)
+
+			rec := httptest.NewRecorder()
+			if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+				t.Error("expected an anonymous identity to be rejected")
+			}
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+			}
+
+			rec = httptest.NewRecorder()
+			if !h.Handle(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil)) {
+				t.Errorf("expected the anonymous identity to be tolerated on an allowlisted path, got status %d", rec.Code)
+			}
+		})
+	}
+}
+
+func TestTruncateReason(t *testing.T) {
+	if got := truncateReason("short", 100); got != "short" {
+		t.Errorf("expected short reasons to pass through, got %q", got)
+	}
+	got := truncateReason("0123456789", 4)
+	if got != "0123...(truncated)" {
+		t.Errorf("expected the reason to be capped with a marker, got %q", got)
+	}
+	long := strings.Repeat("x", defaultMaxReasonLength+10)
+	if got := truncateReason(long, 0); len(got) != defaultMaxReasonLength+len("...(truncated)") {
+		t.Errorf("expected a non-positive limit to apply the default cap, got length %d", len(got))
+	}
+}
+
+func TestPathRuleMatchStrategies(t *testing.T) {
+	rules := []PathAuthorizationRule{
+		{Path: "/api/*", ResourceAttributes: &ResourceAttributes{Resource: "broad"}},
+		{Path: "/api/v1/pods*", ResourceAttributes: &ResourceAttributes{Resource: "narrow"}},
+	}
+	u := &user.DefaultInfo{Name: "jane"}
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+
+	for _, tc := range []struct {
+		strategy      string
+		wantResources []string
+	}{
+		{strategy: "", wantResources: []string{"broad"}},
+		{strategy: RuleMatchFirst, wantResources: []string{"broad"}},
+		{strategy: RuleMatchMostSpecific, wantResources: []string{"narrow"}},
+		{strategy: RuleMatchAllMustPass, wantResources: []string{"broad", "narrow"}},
+	} {
+		t.Run(tc.strategy, func(t *testing.T) {
+			g := newKubeRBACProxyAuthorizerAttributesGetter(&AuthzConfig{
+				PathRules:         rules,
+				RuleMatchStrategy: tc.strategy,
+			})
+			attrs := g.GetRequestAttributes(u, req)
+			if len(attrs) != len(tc.wantResources) {
+				t.Fatalf("expected %d records, got %v", len(tc.wantResources), attrs)
+			}
+			for i, want := range tc.wantResources {
+				if got := attrs[i].GetResource(); got != want {
+					t.Errorf("record %d: expected resource %q, got %q", i, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleShedsRequestsBeyondBackendRateLimit(t *testing.T) {
+	cfg := testConfig()
+	cfg.BackendRateLimit = &BackendRateLimitConfig{QPS: 0.5, Burst: 1}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), &recordingAuthorizer{}, cfg)
+
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Fatalf("expected the first request to fit the burst, got status %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Fatal("expected the second request to be shed")
+	}
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("expected a Retry-After hint derived from the rate, got %q", got)
+	}
+}
+
+func TestBuildAuthnRejectsNegativeCacheTTL(t *testing.T) {
+	if _, err := buildAuthn(nil, &AuthnConfig{CacheTTL: -time.Minute, Header: &AuthnHeaderConfig{}}, NewReloader()); err == nil {
+		t.Error("expected a negative authentication cache TTL to be rejected")
+	}
+
+	cfg := testConfig()
+	cfg.Authentication.CacheTTL = -time.Minute
+	if _, err := BuildAuthHandler(allowAllKubeClient("unused"), cfg); err == nil {
+		t.Error("expected the handler constructor to surface the negative cache TTL")
+	}
+}
+
+func TestRewriteByHTTPHeader(t *testing.T) {
+	g := newKubeRBACProxyAuthorizerAttributesGetter(&AuthzConfig{
+		Rewrites: &SubjectAccessReviewRewrites{
+			ByHTTPHeader: &HTTPHeaderRewriteConfig{Name: "X-Namespace"},
+		},
+		ResourceAttributes: &ResourceAttributes{
+			Namespace: "{{ .Value }}",
+			Resource:  "pods",
+		},
+	})
+	u := &user.DefaultInfo{Name: "jane"}
+
+	req := httptest.NewRequest(http.MethodGet, "/api", nil)
+	req.Header.Set("X-Namespace", "team-a")
+	attrs := g.GetRequestAttributes(u, req)
+	if len(attrs) != 1 || attrs[0].GetNamespace() != "team-a" {
+		t.Fatalf("expected one record for the header-derived namespace, got %v", attrs)
+	}
+
+	// Without the header there is nothing to capture, so the request yields
+	// no attributes and fails authorization.
+	req = httptest.NewRequest(http.MethodGet, "/api", nil)
+	if attrs := g.GetRequestAttributes(u, req); attrs != nil {
+		t.Errorf("expected no attributes without the configured header, got %v", attrs)
+	}
+}
+
+func TestDeepCopyKeepsRewrites(t *testing.T) {
+	orig := &AuthConfig{
+		Authentication: &AuthnConfig{Header: &AuthnHeaderConfig{UserFieldName: "x-remote-user"}},
+		Authorization: &AuthzConfig{
+			Rewrites: &SubjectAccessReviewRewrites{
+				ByQueryParameter: &QueryParameterRewriteConfig{Name: "namespace"},
+				ByHTTPHeader:     &HTTPHeaderRewriteConfig{Name: "X-Namespace"},
+				ByPathRegex:      &PathRegexRewriteConfig{Pattern: "^/api/(?P<ns>[a-z0-9-]+)/"},
+			},
+			ResourceAttributes: &ResourceAttributes{Namespace: "{{ .Value }}"},
+		},
+	}
+
+	copied := orig.DeepCopy()
+	rw := copied.Authorization.Rewrites
+	if rw == nil {
+		t.Fatal("expected the copy to keep the Rewrites field")
+	}
+	if rw.ByQueryParameter == nil || rw.ByQueryParameter.Name != "namespace" {
+		t.Errorf("expected the query parameter rewrite to be copied, got %v", rw.ByQueryParameter)
+	}
+	if rw.ByHTTPHeader == nil || rw.ByHTTPHeader.Name != "X-Namespace" {
+		t.Errorf("expected the header rewrite to be copied, got %v", rw.ByHTTPHeader)
+	}
+	if rw.ByPathRegex == nil || rw.ByPathRegex.Pattern == "" {
+		t.Errorf("expected the path regex rewrite to be copied, got %v", rw.ByPathRegex)
+	}
+
+	// The copy is independent of the original.
+	rw.ByQueryParameter.Name = "changed"
+	if orig.Authorization.Rewrites.ByQueryParameter.Name != "namespace" {
+		t.Error("expected mutating the copy not to affect the original")
+	}
+}
+
+func TestHandleIncludesSelectorsInUserExtra(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization.IncludeSelectors = true
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/pods?fieldSelector=spec.nodeName%3Dnode-1&labelSelector=app%3Dweb", nil)
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, req) {
+		t.Fatalf("expected the request to be admitted, got status %d", rec.Code)
+	}
+
+	got := authz.recorded()
+	if len(got) != 1 {
+		t.Fatalf("expected one authorization, got %d", len(got))
+	}
+	extra := got[0].GetUser().GetExtra()
+	if v := extra["authorization.kubernetes.io/field-selector"]; len(v) != 1 || v[0] != "spec.nodeName=node-1" {
+		t.Errorf("expected the field selector extra, got %v", v)
+	}
+	if v := extra["authorization.kubernetes.io/label-selector"]; len(v) != 1 || v[0] != "app=web" {
+		t.Errorf("expected the label selector extra, got %v", v)
+	}
+}
+
+// capturingLogger records handler log lines for assertions.
+type capturingLogger struct {
+	mu     sync.Mutex
+	errors []string
+	infos  []string
+}
+
+func (l *capturingLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, msg+formatKeysAndValues(keysAndValues))
+}
+
+func (l *capturingLogger) Info(level int, msg string, keysAndValues ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.infos = append(l.infos, msg+formatKeysAndValues(keysAndValues))
+}
+
+func TestHandleAnswers500OnAuthorizerErrors(t *testing.T) {
+	authz := &recordingAuthorizer{
+		decide: func(authorizer.Attributes) (authorizer.Decision, string, error) {
+			return authorizer.DecisionNoOpinion, "", errors.New("webhook unavailable")
+		},
+	}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, testConfig())
+	logger := &capturingLogger{}
+	h.SetLogger(logger)
+
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Error("expected an authorizer error to fail the request")
+	}
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+
+	found := false
+	for _, line := range logger.errors {
+		if strings.Contains(line, "webhook unavailable") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected the authorizer error to be logged, got %v", logger.errors)
+	}
+}
+
+func TestVerbOverridesChangeTheDerivedVerb(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization.ResourceAttributes = &ResourceAttributes{Resource: "pods"}
+	cfg.Authorization.VerbOverrides = map[string]string{"POST": "update"}
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, httptest.NewRequest(http.MethodPost, "/api/v1/pods", nil)) {
+		t.Fatalf("expected the request to be admitted, got status %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	if !h.Handle(rec, httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)) {
+		t.Fatalf("expected the request to be admitted, got status %d", rec.Code)
+	}
+
+	got := authz.recorded()
+	if len(got) != 2 {
+		t.Fatalf("expected two authorizations, got %d", len(got))
+	}
+	if got[0].GetVerb() != "update" {
+		t.Errorf("expected the overridden verb %q for POST, got %q", "update", got[0].GetVerb())
+	}
+	if got[1].GetVerb() != "get" {
+		t.Errorf("expected the default verb %q for GET, got %q", "get", got[1].GetVerb())
+	}
+}
+
+func TestSetProxyIdentityAnnotatesTheRequester(t *testing.T) {
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, testConfig())
+	h.SetProxyIdentity("proxy-7")
+
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Fatalf("expected the request to be admitted, got status %d", rec.Code)
+	}
+	got := authz.recorded()
+	if len(got) != 1 {
+		t.Fatalf("expected one authorization, got %d", len(got))
+	}
+	if v := got[0].GetUser().GetExtra()["kube-rbac-proxy/identity"]; len(v) != 1 || v[0] != "proxy-7" {
+		t.Errorf("expected the proxy identity extra, got %v", v)
+	}
+}
+
+func TestNonResourceAttributesFromConfig(t *testing.T) {
+	g := newKubeRBACProxyAuthorizerAttributesGetter(&AuthzConfig{
+		NonResourceAttributes: &NonResourceAttributes{Path: "/debug", Verb: "get"},
+	})
+	u := &user.DefaultInfo{Name: "jane"}
+
+	attrs := g.GetRequestAttributes(u, httptest.NewRequest(http.MethodPost, "/debug/pprof/heap", nil))
+	if len(attrs) != 1 {
+		t.Fatalf("expected one record, got %v", attrs)
+	}
+	if attrs[0].IsResourceRequest() {
+		t.Error("expected a non-resource record")
+	}
+	if got := attrs[0].GetPath(); got != "/debug" {
+		t.Errorf("expected the configured path override %q, got %q", "/debug", got)
+	}
+	if got := attrs[0].GetVerb(); got != "get" {
+		t.Errorf("expected the configured verb override %q, got %q", "get", got)
+	}
+}
+
+func TestHandleEmitsServerTimingHeader(t *testing.T) {
+	cfg := testConfig()
+	cfg.ServerTiming = true
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), &recordingAuthorizer{}, cfg)
+
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Fatalf("expected the request to be admitted, got status %d", rec.Code)
+	}
+	timing := rec.Header().Get("Server-Timing")
+	if !strings.Contains(timing, "authn;dur=") || !strings.Contains(timing, "authz;dur=") {
+		t.Errorf("expected authn and authz timing entries, got %q", timing)
+	}
+}
+
+func TestHandleForwardsUserExtraAsHeaders(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authentication.Header.Enabled = true
+	cfg.Authentication.Header.ExtraFieldPrefix = "x-remote-extra-"
+	u := &user.DefaultInfo{
+		Name:   "jane",
+		Groups: []string{"admins"},
+		Extra: map[string][]string{
+			"authentication.kubernetes.io/scopes": {"read", "write"},
+		},
+	}
+	h := newKubeRBACProxyAuth(&staticAuthenticator{u: u, ok: true}, &recordingAuthorizer{}, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, req) {
+		t.Fatalf("expected the request to be admitted, got status %d", rec.Code)
+	}
+	// The extra key is reduced to RFC 7230 token characters under the prefix,
+	// and multi-valued extras are joined with the group separator.
+	got := req.Header.Get("x-remote-extra-authentication.kubernetes.ioscopes")
+	if got != "read|write" {
+		t.Errorf("expected the joined extra values under the prefixed header, got %v", req.Header)
+	}
+}
+
+func TestVerbParameterSuppliesPerValueVerbs(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization = &AuthzConfig{
+		Rewrites: &SubjectAccessReviewRewrites{
+			ByQueryParameter: &QueryParameterRewriteConfig{Name: "namespace", VerbParameter: "verb"},
+		},
+		ResourceAttributes: &ResourceAttributes{
+			Namespace: "{{ .Value }}",
+			Resource:  "pods",
+		},
+	}
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/api?namespace=team-a&namespace=team-b&verb=list&verb=watch", nil)
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, req) {
+		t.Fatalf("expected the request to be admitted, got status %d", rec.Code)
+	}
+
+	got := authz.recorded()
+	if len(got) != 2 {
+		t.Fatalf("expected one authorization per captured value, got %d", len(got))
+	}
+	if got[0].GetNamespace() != "team-a" || got[0].GetVerb() != "list" {
+		t.Errorf("expected team-a/list, got %s/%s", got[0].GetNamespace(), got[0].GetVerb())
+	}
+	if got[1].GetNamespace() != "team-b" || got[1].GetVerb() != "watch" {
+		t.Errorf("expected team-b/watch, got %s/%s", got[1].GetNamespace(), got[1].GetVerb())
+	}
+}
+
+func TestBuildAuthHandlerWithAuthorizer(t *testing.T) {
+	if _, err := BuildAuthHandlerWithAuthorizer(nil, nil, testConfig()); err == nil {
+		t.Error("expected a nil authorizer to be rejected")
+	}
+
+	authz := &recordingAuthorizer{
+		decide: func(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+			if attrs.GetUser().GetName() == "jane" {
+				return authorizer.DecisionAllow, "", nil
+			}
+			return authorizer.DecisionDeny, "not jane", nil
+		},
+	}
+	h, err := BuildAuthHandlerWithAuthorizer(allowAllKubeClient("jane"), authz, testConfig())
+	if err != nil {
+		t.Fatalf("unexpected handler error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer some-token")
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, req) {
+		t.Errorf("expected the caller-supplied authorizer to admit the request, got status %d", rec.Code)
+	}
+	if got := authz.recorded(); len(got) == 0 {
+		t.Error("expected the caller-supplied authorizer to be consulted")
+	}
+}
+
+func TestHandleRecordsTenantMetrics(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization = &AuthzConfig{
+		Rewrites: &SubjectAccessReviewRewrites{
+			ByQueryParameter: &QueryParameterRewriteConfig{Name: "namespace"},
+		},
+		ResourceAttributes: &ResourceAttributes{
+			Namespace: "{{ .Value }}",
+			Resource:  "pods",
+		},
+		TenantMetrics: true,
+	}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), &recordingAuthorizer{}, cfg)
+
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, httptest.NewRequest(http.MethodGet, "/api?namespace=tenant-512", nil)) {
+		t.Fatalf("expected the request to be admitted, got status %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	mrec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(mrec, req)
+	want := `kube_rbac_proxy_tenant_authorization_decisions_total{decision="allow",tenant="tenant-512"} 1`
+	if !strings.Contains(mrec.Body.String(), want) {
+		t.Errorf("expected the exposition to contain %q", want)
+	}
+}
+
+func TestCNGroupsAugmentTheUsersGroups(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authentication.CNGroups = map[string]string{"client-a": "tenant-a-readers"}
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authenticateAs("client-a", "base"), authz, cfg)
+
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Fatalf("expected the request to be admitted, got status %d", rec.Code)
+	}
+	got := authz.recorded()
+	if len(got) != 1 {
+		t.Fatalf("expected one authorization, got %d", len(got))
+	}
+	groups := got[0].GetUser().GetGroups()
+	found := false
+	for _, g := range groups {
+		if g == "tenant-a-readers" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected the CN-mapped group to be added, got %v", groups)
+	}
+
+	// A user without a mapping keeps its groups untouched.
+	authz2 := &recordingAuthorizer{}
+	h = newKubeRBACProxyAuth(authenticateAs("client-b", "base"), authz2, cfg)
+	rec = httptest.NewRecorder()
+	if !h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Fatalf("expected the request to be admitted, got status %d", rec.Code)
+	}
+	if groups := authz2.recorded()[0].GetUser().GetGroups(); len(groups) != 1 || groups[0] != "base" {
+		t.Errorf("expected unmapped users to keep their groups, got %v", groups)
+	}
+}
+
+func TestHandleEnforcesRequiredScopes(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization.PathRules = []PathAuthorizationRule{
+		{Path: "/admin/*", RequiredScopes: []string{"admin"}},
+	}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), &recordingAuthorizer{}, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/settings", nil)
+	req.Header.Set("Authorization", "Bearer "+testJWT(t, map[string]interface{}{"scope": "read"}))
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, req) {
+		t.Error("expected a token without the required scope to be rejected")
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/settings", nil)
+	req.Header.Set("Authorization", "Bearer "+testJWT(t, map[string]interface{}{"scope": "read admin"}))
+	rec = httptest.NewRecorder()
+	if !h.Handle(rec, req) {
+		t.Errorf("expected a token carrying the scope to pass, got status %d", rec.Code)
+	}
+
+	// Paths outside the rule require no scopes.
+	rec = httptest.NewRecorder()
+	if !h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Errorf("expected unscoped paths to pass, got status %d", rec.Code)
+	}
+}
+
+func TestHandleEnforcesRequiredScopesWithHeaderConsumingAuthenticator(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization.PathRules = []PathAuthorizationRule{
+		{Path: "/admin/*", RequiredScopes: []string{"admin"}},
+	}
+	authn := &headerConsumingAuthenticator{delegate: authenticateAs("jane")}
+	h := newKubeRBACProxyAuth(authn, &recordingAuthorizer{}, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/settings", nil)
+	req.Header.Set("Authorization", "Bearer "+testJWT(t, map[string]interface{}{"scope": "admin"}))
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, req) {
+		t.Errorf("expected the scoped token to pass even though the authenticator consumed the header, got status %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/settings", nil)
+	req.Header.Set("Authorization", "Bearer "+testJWT(t, map[string]interface{}{"scope": "read"}))
+	rec = httptest.NewRecorder()
+	if h.Handle(rec, req) {
+		t.Error("expected a token without the required scope to be rejected")
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+}
+
+func TestAllModeRequiresEveryRecordAllowed(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization = &AuthzConfig{
+		Rewrites: &SubjectAccessReviewRewrites{
+			ByQueryParameter: &QueryParameterRewriteConfig{Name: "namespace"},
+		},
+		ResourceAttributes: &ResourceAttributes{
+			Namespace: "{{ .Value }}",
+			Resource:  "pods",
+		},
+	}
+	authz := &recordingAuthorizer{
+		decide: func(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+			if attrs.GetNamespace() == "team-b" {
+				return authorizer.DecisionDeny, "team-b is off limits", nil
+			}
+			return authorizer.DecisionAllow, "", nil
+		},
+	}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/api?namespace=team-a&namespace=team-b", nil)) {
+		t.Error("expected a single denied namespace to fail the whole request")
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	if !h.Handle(rec, httptest.NewRequest(http.MethodGet, "/api?namespace=team-a&namespace=team-c", nil)) {
+		t.Errorf("expected all-allowed namespaces to pass, got status %d", rec.Code)
+	}
+}
+
+func TestAuthzConfigValidateRejectsMalformedRewrites(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  *AuthzConfig
+	}{
+		{
+			name: "malformed template",
+			cfg: &AuthzConfig{
+				Rewrites:           &SubjectAccessReviewRewrites{ByQueryParameter: &QueryParameterRewriteConfig{Name: "namespace"}},
+				ResourceAttributes: &ResourceAttributes{Namespace: "{{ .Value"},
+			},
+		},
+		{
+			name: "malformed query value regex",
+			cfg: &AuthzConfig{
+				Rewrites: &SubjectAccessReviewRewrites{ByQueryParameter: &QueryParameterRewriteConfig{Name: "namespace", ValueRegex: "["}},
+			},
+		},
+		{
+			name: "malformed path pattern",
+			cfg: &AuthzConfig{
+				Rewrites: &SubjectAccessReviewRewrites{ByPathRegex: &PathRegexRewriteConfig{Pattern: "("}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.cfg.Validate(); err == nil {
+				t.Error("expected the configuration to be rejected")
+			}
+			// The handler constructors surface the same error at startup.
+			if _, err := BuildAuthHandler(allowAllKubeClient("unused"), &AuthConfig{
+				Authentication: &AuthnConfig{Header: &AuthnHeaderConfig{}},
+				Authorization:  tc.cfg,
+			}); err == nil {
+				t.Error("expected the handler constructor to reject the configuration")
+			}
+		})
+	}
+}
+
+// blockingAuthenticator blocks until released, simulating a hung backend.
+type blockingAuthenticator struct {
+	release chan struct{}
+}
+
+func (a *blockingAuthenticator) AuthenticateRequest(req *http.Request) (user.Info, bool, error) {
+	<-a.release
+	return &user.DefaultInfo{Name: "late"}, true, nil
+}
+
+func TestHandleAnswers503OnAuthenticationTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	cfg := testConfig()
+	cfg.Timeout = 10 * time.Millisecond
+	h := newKubeRBACProxyAuth(&blockingAuthenticator{release: release}, &recordingAuthorizer{}, cfg)
+
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Error("expected a hung authentication backend to fail the request")
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+}
+
+func TestUnauthorizedResponsesCarryTheChallenge(t *testing.T) {
+	h := newKubeRBACProxyAuth(&staticAuthenticator{}, &recordingAuthorizer{}, testConfig())
+
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Error("expected an unauthenticated request to be rejected")
+	}
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+	if got := rec.Header().Get("WWW-Authenticate"); got != "Bearer" {
+		t.Errorf("expected the default Bearer challenge, got %q", got)
+	}
+
+	cfg := testConfig()
+	cfg.Authentication.Challenge = `Bearer realm="kube-rbac-proxy"`
+	h = newKubeRBACProxyAuth(&staticAuthenticator{}, &recordingAuthorizer{}, cfg)
+	rec = httptest.NewRecorder()
+	h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if got := rec.Header().Get("WWW-Authenticate"); got != cfg.Authentication.Challenge {
+		t.Errorf("expected the configured challenge, got %q", got)
+	}
+}
+
+func TestDedupAttributes(t *testing.T) {
+	u := &user.DefaultInfo{Name: "jane"}
+	a := authorizer.AttributesRecord{User: u, Verb: "get", Namespace: "team-a", Resource: "pods", ResourceRequest: true}
+	b := authorizer.AttributesRecord{User: u, Verb: "get", Namespace: "team-b", Resource: "pods", ResourceRequest: true}
+
+	deduped := dedupAttributes([]authorizer.Attributes{a, b, a, b, a})
+	if len(deduped) != 2 {
+		t.Fatalf("expected two unique records, got %d", len(deduped))
+	}
+	if deduped[0].GetNamespace() != "team-a" || deduped[1].GetNamespace() != "team-b" {
+		t.Errorf("expected first occurrences to be kept in order, got %v", deduped)
+	}
+
+	single := []authorizer.Attributes{a}
+	if got := dedupAttributes(single); len(got) != 1 {
+		t.Errorf("expected a single record to pass through, got %v", got)
+	}
+}
+
+func TestHandleEmitsGroupsAsRepeatedHeader(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authentication.Header.Enabled = true
+	cfg.Authentication.Header.GroupsAsRepeatedHeader = true
+	h := newKubeRBACProxyAuth(authenticateAs("jane", "admins", "viewers"), &recordingAuthorizer{}, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, req) {
+		t.Fatalf("expected the request to be admitted, got status %d", rec.Code)
+	}
+	got := req.Header.Values("x-remote-groups")
+	if len(got) != 2 || got[0] != "admins" || got[1] != "viewers" {
+		t.Errorf("expected one header line per group, got %v", got)
+	}
+
+	// A user without groups sends no groups header at all in this mode.
+	h = newKubeRBACProxyAuth(authenticateAs("jane"), &recordingAuthorizer{}, cfg)
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Fatal("expected the request to be admitted")
+	}
+	if got := req.Header.Values("x-remote-groups"); len(got) != 0 {
+		t.Errorf("expected no groups header for a user without groups, got %v", got)
+	}
+}
+
+func TestHandleJoinsGroupsWithConfiguredSeparator(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authentication.Header.Enabled = true
+	h := newKubeRBACProxyAuth(authenticateAs("jane", "admins", "viewers"), &recordingAuthorizer{}, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Fatal("expected the request to be admitted")
+	}
+	if got := req.Header.Values("x-remote-groups"); len(got) != 1 || got[0] != "admins|viewers" {
+		t.Errorf("expected a single joined groups header, got %v", got)
+	}
+}
+
+func TestRewriteTemplatesExposePathCaptures(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization.ResourceAttributes = &ResourceAttributes{
+		Namespace: "{{ .Captures.tenant }}",
+		Resource:  "pods",
+	}
+	cfg.Authorization.Rewrites = &SubjectAccessReviewRewrites{
+		ByPathRegex: &PathRegexRewriteConfig{Pattern: `/api/v1/tenants/(?P<tenant>[a-z0-9-]+)/.*`},
+	}
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/tenants/acme/pods", nil)
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Fatal("expected the request to be admitted")
+	}
+	attrs := authz.recorded()
+	if len(attrs) != 1 {
+		t.Fatalf("expected one attributes record, got %d", len(attrs))
+	}
+	if got := attrs[0].GetNamespace(); got != "acme" {
+		t.Errorf("expected the named capture to template the namespace, got %q", got)
+	}
+	if !attrs[0].IsResourceRequest() || attrs[0].GetResource() != "pods" {
+		t.Errorf("unexpected record: %#v", attrs[0])
+	}
+
+	// A path outside the pattern carries no attribute data: reject.
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/api/v2/other", nil)) {
+		t.Error("expected a path outside the pattern to be rejected")
+	}
+}
+
+func TestRewriteTemplatesExposeAllParams(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization.ResourceAttributes = &ResourceAttributes{
+		Namespace: "{{ .Value }}",
+		Resource:  "namespaces",
+		Name:      "{{ index .Params 0 }}-{{ index .Params 1 }}",
+	}
+	cfg.Authorization.Rewrites = &SubjectAccessReviewRewrites{
+		ByQueryParameter: &QueryParameterRewriteConfig{Name: "namespace"},
+	}
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics?namespace=ns1&namespace=ns2", nil)
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Fatal("expected the request to be admitted")
+	}
+	attrs := authz.recorded()
+	if len(attrs) != 2 {
+		t.Fatalf("expected one record per captured value, got %d", len(attrs))
+	}
+	for i, want := range []string{"ns1", "ns2"} {
+		if got := attrs[i].GetNamespace(); got != want {
+			t.Errorf("expected record %d to template namespace %q, got %q", i, want, got)
+		}
+		// Every record sees the full parameter list, not only its own value.
+		if got := attrs[i].GetName(); got != "ns1-ns2" {
+			t.Errorf("expected record %d to see all params, got name %q", i, got)
+		}
+	}
+}
+
+func TestHandleAuthorizesDuplicateRecordsOnlyOnce(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization.ResourceAttributes = &ResourceAttributes{Namespace: "{{ .Value }}", Resource: "namespaces"}
+	cfg.Authorization.Rewrites = &SubjectAccessReviewRewrites{
+		ByQueryParameter: &QueryParameterRewriteConfig{Name: "namespace"},
+	}
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+
+	// Three repeated values and one distinct one: the backend must be asked
+	// exactly once per distinct attribute tuple, even on a cold cache.
+	req := httptest.NewRequest(http.MethodGet, "/metrics?namespace=ns1&namespace=ns1&namespace=ns2&namespace=ns1", nil)
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Fatal("expected the request to be admitted")
+	}
+	attrs := authz.recorded()
+	if len(attrs) != 2 {
+		t.Fatalf("expected one authorize call per distinct record, got %d", len(attrs))
+	}
+	seen := map[string]bool{}
+	for _, a := range attrs {
+		seen[a.GetNamespace()] = true
+	}
+	if !seen["ns1"] || !seen["ns2"] {
+		t.Errorf("expected both distinct namespaces to be authorized, got %v", seen)
+	}
+}
+
+func TestHandleAlwaysChecksTheBaseRecord(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization.ResourceAttributes = &ResourceAttributes{Namespace: "{{ .Value }}", Resource: "namespaces"}
+	cfg.Authorization.BaseResourceAttributes = &ResourceAttributes{Namespace: "monitoring", Resource: "services", Name: "kube-rbac-proxy"}
+	cfg.Authorization.Rewrites = &SubjectAccessReviewRewrites{
+		ByQueryParameter: &QueryParameterRewriteConfig{Name: "namespace", Mode: RewriteModeAny},
+	}
+
+	// The static base check must fail the request even when a rewritten
+	// record is allowed and "any" mode would otherwise stop at it.
+	authz := &recordingAuthorizer{
+		decide: func(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+			if attrs.GetResource() == "services" {
+				return authorizer.DecisionDeny, "missing the static capability", nil
+			}
+			return authorizer.DecisionAllow, "", nil
+		},
+	}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics?namespace=ns1", nil)) {
+		t.Error("expected a denied base record to reject the request")
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+	// The base record is checked first, before any rewritten record.
+	attrs := authz.recorded()
+	if len(attrs) == 0 || attrs[0].GetResource() != "services" {
+		t.Fatalf("expected the base record to be authorized first, got %#v", attrs)
+	}
+
+	// With both the base and a rewritten record allowed, the request passes.
+	authz = &recordingAuthorizer{}
+	h = newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+	if !h.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics?namespace=ns1", nil)) {
+		t.Error("expected the request to be admitted when base and rewritten records are allowed")
+	}
+	if got := len(authz.recorded()); got != 2 {
+		t.Errorf("expected the base and the rewritten record to be checked, got %d records", got)
+	}
+}
+
+func TestHandleEnforcesAllowedMethods(t *testing.T) {
+	cfg := testConfig()
+	cfg.AllowedMethods = []string{"GET", "HEAD"}
+	authn := &countingAuthenticator{staticAuthenticator: staticAuthenticator{u: &user.DefaultInfo{Name: "jane"}, ok: true}}
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authn, authz, cfg)
+
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil)) {
+		t.Error("expected an unlisted method to be rejected")
+	}
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+	if got := rec.Header().Get("Allow"); got != "GET, HEAD" {
+		t.Errorf("expected an Allow header listing the accepted methods, got %q", got)
+	}
+	// The rejection happens before any authentication or authorization work.
+	if authn.calls != 0 || len(authz.recorded()) != 0 {
+		t.Errorf("expected no auth work for a rejected method, got %d authn calls and %d authz records", authn.calls, len(authz.recorded()))
+	}
+
+	// Listed methods proceed as usual.
+	if !h.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Error("expected a listed method to be admitted")
+	}
+
+	// Without a configured list every method is accepted.
+	h = newKubeRBACProxyAuth(authenticateAs("jane"), &recordingAuthorizer{}, testConfig())
+	if !h.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/metrics", nil)) {
+		t.Error("expected any method to be accepted without an allowed methods list")
+	}
+}
+
+func TestNonResourceRequestsUseLowercasedMethodVerbs(t *testing.T) {
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, testConfig())
+
+	// Without resource attributes the SAR is a non-resource check; its verb
+	// is the lowercased HTTP method, not the REST-style mapping.
+	req := httptest.NewRequest(http.MethodPost, "/metrics", nil)
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Fatal("expected the request to be admitted")
+	}
+	attrs := authz.recorded()
+	if len(attrs) != 1 {
+		t.Fatalf("expected one attributes record, got %d", len(attrs))
+	}
+	if attrs[0].IsResourceRequest() {
+		t.Error("expected a non-resource record")
+	}
+	if got := attrs[0].GetVerb(); got != "post" {
+		t.Errorf("expected verb %q, got %q", "post", got)
+	}
+	if got := attrs[0].GetPath(); got != "/metrics" {
+		t.Errorf("expected path %q, got %q", "/metrics", got)
+	}
+}
+
+func TestNonResourceVerbOverrides(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization.NonResourceVerbOverrides = map[string]string{"post": "create"}
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+
+	if !h.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/metrics", nil)) {
+		t.Fatal("expected the request to be admitted")
+	}
+	attrs := authz.recorded()
+	if len(attrs) != 1 || attrs[0].GetVerb() != "create" {
+		t.Fatalf("expected the configured override verb, got %#v", attrs)
+	}
+
+	// Methods without an override keep the lowercased method.
+	authz = &recordingAuthorizer{}
+	h = newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+	if !h.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Fatal("expected the request to be admitted")
+	}
+	if attrs := authz.recorded(); len(attrs) != 1 || attrs[0].GetVerb() != "get" {
+		t.Fatalf("expected the lowercased method verb, got %#v", attrs)
+	}
+}
+
+func TestHandleShedsBeforeReachingTheBackends(t *testing.T) {
+	cfg := testConfig()
+	cfg.BackendRateLimit = &BackendRateLimitConfig{QPS: 0.1, Burst: 1}
+	authn := &countingAuthenticator{staticAuthenticator: staticAuthenticator{u: &user.DefaultInfo{Name: "jane"}, ok: true}}
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authn, authz, cfg)
+
+	if !h.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Fatal("expected the first request to fit the burst")
+	}
+	calls := authn.calls
+
+	// The shed request must not translate into backend load at all.
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Fatal("expected the second request to be shed")
+	}
+	if authn.calls != calls {
+		t.Errorf("expected no authentication for a shed request, got %d extra calls", authn.calls-calls)
+	}
+	if got := len(authz.recorded()); got != 1 {
+		t.Errorf("expected no authorization for a shed request, got %d records", got)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("expected the Retry-After hint to reflect the 0.1 QPS rate, got %q", got)
+	}
+}
+
+func TestHandleRetryAfterDefaultsToOneSecond(t *testing.T) {
+	cfg := testConfig()
+	cfg.BackendRateLimit = &BackendRateLimitConfig{QPS: 2, Burst: 1}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), &recordingAuthorizer{}, cfg)
+
+	h.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Fatal("expected the second request to be shed")
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("expected the minimum Retry-After hint, got %q", got)
+	}
+}
+
+func TestStaticRecordWithResourceRequestFalse(t *testing.T) {
+	cfg := testConfig()
+	falseVal := false
+	cfg.Authorization.ResourceAttributes = &ResourceAttributes{
+		ResourceRequest: &falseVal,
+		Path:            "/metrics",
+	}
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+
+	// The fixed path decouples the check from the live request path.
+	req := httptest.NewRequest(http.MethodGet, "/metrics/cadvisor?query=1", nil)
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Fatal("expected the request to be admitted")
+	}
+	attrs := authz.recorded()
+	if len(attrs) != 1 {
+		t.Fatalf("expected one attributes record, got %d", len(attrs))
+	}
+	if attrs[0].IsResourceRequest() {
+		t.Error("expected a non-resource record")
+	}
+	if got := attrs[0].GetPath(); got != "/metrics" {
+		t.Errorf("expected the configured path, got %q", got)
+	}
+	if got := attrs[0].GetVerb(); got != "get" {
+		t.Errorf("expected the non-resource verb, got %q", got)
+	}
+
+	// Without a configured path the live request path is checked instead.
+	cfg = testConfig()
+	cfg.Authorization.ResourceAttributes = &ResourceAttributes{ResourceRequest: &falseVal}
+	authz = &recordingAuthorizer{}
+	h = newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+	if !h.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/probe", nil)) {
+		t.Fatal("expected the request to be admitted")
+	}
+	if attrs := authz.recorded(); len(attrs) != 1 || attrs[0].GetPath() != "/probe" {
+		t.Fatalf("expected the request path to be checked, got %#v", attrs)
+	}
+}
+
+func TestMiddlewareInvokesNextOnlyWhenAdmitted(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authentication.Header.Enabled = true
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), &recordingAuthorizer{}, cfg)
+
+	nextCalled := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		nextCalled = true
+		// The identity headers are already injected when next runs.
+		if got := req.Header.Get("x-remote-user"); got != "jane" {
+			t.Errorf("expected the injected user header, got %q", got)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	rec := httptest.NewRecorder()
+	h.Middleware(next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !nextCalled {
+		t.Error("expected next to run for an admitted request")
+	}
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	// A denied request short-circuits: Handle writes the response and next
+	// never runs.
+	nextCalled = false
+	h = newKubeRBACProxyAuth(&staticAuthenticator{}, &recordingAuthorizer{}, cfg)
+	rec = httptest.NewRecorder()
+	h.Middleware(next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if nextCalled {
+		t.Error("expected next not to run for a denied request")
+	}
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
+
+func TestHandleSkipsAuthorizationForVerbsOutsideTheList(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization.AuthorizeVerbs = []string{"post", "put", "delete"}
+	authz := &recordingAuthorizer{
+		decide: func(authorizer.Attributes) (authorizer.Decision, string, error) {
+			return authorizer.DecisionDeny, "denied by test", nil
+		},
+	}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+
+	// Reads map to "get", which is outside the list: authentication only.
+	if !h.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Error("expected a read outside the authorize-verbs list to pass with authentication only")
+	}
+	if got := len(authz.recorded()); got != 0 {
+		t.Errorf("expected no authorization for a skipped verb, got %d records", got)
+	}
+
+	// Writes map to "post" and stay subject to authorization.
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil)) {
+		t.Error("expected a write inside the authorize-verbs list to be authorized and denied")
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+
+	// Authentication is still required for skipped verbs.
+	h = newKubeRBACProxyAuth(&staticAuthenticator{}, authz, cfg)
+	rec = httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Error("expected an unauthenticated request to be rejected despite the skipped verb")
+	}
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
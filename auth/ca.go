@@ -0,0 +1,176 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	x509request "k8s.io/apiserver/pkg/authentication/request/x509"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// reloadableCertPool holds the certificate verification pool built from a CA
+// bundle file and can re-read it on demand, typically through a Reloader. A
+// reload only swaps the pool in when the new bundle contains at least one
+// valid certificate; catching a rotation mid-write (a partial or empty file)
+// therefore keeps the previous, working pool instead of breaking all x509
+// authentication.
+type reloadableCertPool struct {
+	path string
+
+	mu   sync.RWMutex
+	pool *x509.CertPool
+}
+
+func newReloadableCertPool(path string) (*reloadableCertPool, error) {
+	p := &reloadableCertPool{path: path}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// current returns the most recently loaded pool.
+func (p *reloadableCertPool) current() *x509.CertPool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.pool
+}
+
+// reload re-reads the CA bundle. On any error — unreadable file, no valid
+// certificate in the bundle — the previous pool stays in place.
+func (p *reloadableCertPool) reload() error {
+	pemBytes, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return fmt.Errorf("failed to read CA bundle %q: %v", p.path, err)
+	}
+
+	pool, count := poolFromPEM(pemBytes)
+	if count == 0 {
+		return fmt.Errorf("CA bundle %q contains no valid certificates", p.path)
+	}
+
+	p.mu.Lock()
+	p.pool = pool
+	p.mu.Unlock()
+	return nil
+}
+
+// watch periodically stats the CA bundle file and reloads the pool when its
+// modification time changed, so a rotated CA (e.g. by cert-manager) is picked
+// up without a restart. Reloads and reload failures are logged; a failing
+// reload keeps the previous pool. The loop never terminates — the bundle is
+// watched for the lifetime of the process.
+func (p *reloadableCertPool) watch(interval time.Duration) {
+	var lastModTime time.Time
+	if fi, err := os.Stat(p.path); err == nil {
+		lastModTime = fi.ModTime()
+	}
+
+	for range time.Tick(interval) {
+		fi, err := os.Stat(p.path)
+		if err != nil {
+			glog.Errorf("Failed to stat client CA bundle %q: %v", p.path, err)
+			continue
+		}
+		if fi.ModTime().Equal(lastModTime) {
+			continue
+		}
+		lastModTime = fi.ModTime()
+
+		if err := p.reload(); err != nil {
+			glog.Errorf("Failed to reload client CA bundle %q, keeping previous bundle: %v", p.path, err)
+			continue
+		}
+		glog.Infof("Reloaded client CA bundle %q", p.path)
+	}
+}
+
+// reloadingX509Authenticator authenticates client certificates against the
+// most recently loaded CA pool instead of a pool fixed at startup. Identity
+// mapping matches the static x509 authenticator: the subject common name
+// becomes the user name, the organization fields become groups.
+type reloadingX509Authenticator struct {
+	pool *reloadableCertPool
+}
+
+func (a *reloadingX509Authenticator) AuthenticateRequest(req *http.Request) (user.Info, bool, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil, false, nil
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:     a.pool.current(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if len(req.TLS.PeerCertificates) > 1 {
+		opts.Intermediates = x509.NewCertPool()
+		for _, intermediate := range req.TLS.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(intermediate)
+		}
+	}
+
+	chains, err := req.TLS.PeerCertificates[0].Verify(opts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, chain := range chains {
+		u, ok, err := x509request.CommonNameUserConversion.User(chain)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return u, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// poolFromPEM builds a certificate pool from PEM data, returning the number
+// of certificates that parsed successfully. Undecodable blocks are skipped
+// rather than failing the whole bundle.
+func poolFromPEM(pemBytes []byte) (*x509.CertPool, int) {
+	pool := x509.NewCertPool()
+	count := 0
+	for len(pemBytes) > 0 {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" || len(block.Headers) != 0 {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		pool.AddCert(cert)
+		count++
+	}
+	return pool, count
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// userContextKey is the context key the authenticated identity is stored
+// under. It is unexported so WithUser and UserFrom are the only accessors.
+type userContextKey struct{}
+
+// WithUser returns a context carrying the authenticated user. Handle calls it
+// on the request of every admitted request; embedders composing their own
+// middleware can use it directly.
+func WithUser(ctx context.Context, u user.Info) context.Context {
+	return context.WithValue(ctx, userContextKey{}, u)
+}
+
+// UserFrom returns the authenticated identity Handle resolved for the
+// request, for downstream handlers doing logging, audit, or additional
+// business logic. The second return value is false when the request did not
+// pass through a successful Handle (e.g. an ignored path, or a context
+// outside the proxy entirely).
+func UserFrom(ctx context.Context) (user.Info, bool) {
+	u, ok := ctx.Value(userContextKey{}).(user.Info)
+	return u, ok
+}
+
+// tokenExpiryContextKey is the context key the presented token's expiry is
+// stored under.
+type tokenExpiryContextKey struct{}
+
+// WithTokenExpiry returns a context carrying the expiry claim of the bearer
+// token the request presented. Handle calls it for every admitted request
+// whose token carried one; embedders composing their own middleware can use
+// it directly.
+func WithTokenExpiry(ctx context.Context, exp time.Time) context.Context {
+	return context.WithValue(ctx, tokenExpiryContextKey{}, exp)
+}
+
+// TokenExpiryFrom returns the expiry claim of the bearer token an admitted
+// request presented. Handle captures it before the authenticator consumes
+// the Authorization header, so it remains available to callers bounding
+// long-lived connections after authentication. The second return value is
+// false when the request presented no token or the token carried no expiry.
+func TokenExpiryFrom(ctx context.Context) (time.Time, bool) {
+	exp, ok := ctx.Value(tokenExpiryContextKey{}).(time.Time)
+	return exp, ok
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+func TestWithUserRoundTrip(t *testing.T) {
+	u := &user.DefaultInfo{Name: "jane", Groups: []string{"admins"}}
+	ctx := WithUser(context.Background(), u)
+
+	got, ok := UserFrom(ctx)
+	if !ok {
+		t.Fatal("expected the user to be retrievable from the context")
+	}
+	if got.GetName() != "jane" {
+		t.Errorf("expected user %q, got %q", "jane", got.GetName())
+	}
+
+	if _, ok := UserFrom(context.Background()); ok {
+		t.Error("expected no user on a fresh context")
+	}
+}
+
+func TestHandleStashesTheUserOnTheRequestContext(t *testing.T) {
+	h := newKubeRBACProxyAuth(authenticateAs("jane", "admins"), &recordingAuthorizer{}, testConfig())
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Fatal("expected the request to be admitted")
+	}
+	u, ok := UserFrom(req.Context())
+	if !ok {
+		t.Fatal("expected the resolved identity on the request context")
+	}
+	if u.GetName() != "jane" {
+		t.Errorf("expected user %q, got %q", "jane", u.GetName())
+	}
+	if groups := u.GetGroups(); len(groups) != 1 || groups[0] != "admins" {
+		t.Errorf("unexpected groups %v", groups)
+	}
+}
+
+func TestHandleStashesTheTokenExpiryOnTheRequestContext(t *testing.T) {
+	// The authenticator consumes the Authorization header; the expiry must
+	// still be retrievable after Handle for bounding long-lived connections.
+	h := newKubeRBACProxyAuth(&headerConsumingAuthenticator{delegate: authenticateAs("jane")}, &recordingAuthorizer{}, testConfig())
+
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+testJWT(t, map[string]interface{}{"exp": exp.Unix()}))
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Fatal("expected the request to be admitted")
+	}
+	got, ok := TokenExpiryFrom(req.Context())
+	if !ok {
+		t.Fatal("expected the token expiry on the request context")
+	}
+	if !got.Equal(exp) {
+		t.Errorf("expected expiry %v, got %v", exp, got)
+	}
+
+	// A tokenless request carries no expiry.
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Fatal("expected the request to be admitted")
+	}
+	if _, ok := TokenExpiryFrom(req.Context()); ok {
+		t.Error("expected no expiry on a tokenless request")
+	}
+}
+
+func TestMiddlewareExposesTheUserToNext(t *testing.T) {
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), &recordingAuthorizer{}, testConfig())
+
+	var seen user.Info
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen, _ = UserFrom(req.Context())
+	})
+	h.Middleware(next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if seen == nil || seen.GetName() != "jane" {
+		t.Errorf("expected next to see the authenticated user, got %v", seen)
+	}
+}
+
+func TestIgnoredPathsCarryNoUser(t *testing.T) {
+	cfg := testConfig()
+	cfg.IgnorePaths = []string{"/healthz"}
+	h := newKubeRBACProxyAuth(&staticAuthenticator{}, &recordingAuthorizer{}, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Fatal("expected the ignored path to be proxied through")
+	}
+	if _, ok := UserFrom(req.Context()); ok {
+		t.Error("expected no identity on an ignored path")
+	}
+}
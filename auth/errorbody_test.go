@@ -0,0 +1,140 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+func TestWriteErrorDefaultsToStatusText(t *testing.T) {
+	authz := &recordingAuthorizer{
+		decide: func(authorizer.Attributes) (authorizer.Decision, string, error) {
+			return authorizer.DecisionDeny, "user jane may not get /metrics", nil
+		},
+	}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, testConfig())
+
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Fatal("expected the denied request to be rejected")
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+	body := rec.Body.String()
+	if strings.TrimSpace(body) != http.StatusText(http.StatusForbidden) {
+		t.Errorf("expected the generic status text, got %q", body)
+	}
+	// The denied action stays in the logs; the body must not name it.
+	for _, leak := range []string{"jane", "/metrics"} {
+		if strings.Contains(body, leak) {
+			t.Errorf("expected the body not to contain %q", leak)
+		}
+	}
+}
+
+func TestWriteErrorJSONMode(t *testing.T) {
+	cfg := testConfig()
+	cfg.ErrorBodies = &ErrorBodyConfig{Mode: ErrorBodyJSON}
+	h := newKubeRBACProxyAuth(&staticAuthenticator{}, &recordingAuthorizer{}, cfg)
+
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Fatal("expected the unauthenticated request to be rejected")
+	}
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Fatalf("expected an application/json body, got Content-Type %q", got)
+	}
+	var body struct {
+		Error  string `json:"error"`
+		Status int    `json:"status"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unexpected error decoding the body: %v", err)
+	}
+	if body.Status != http.StatusUnauthorized || body.Error != http.StatusText(http.StatusUnauthorized) {
+		t.Errorf("unexpected JSON error body: %+v", body)
+	}
+}
+
+func TestWriteErrorOverrides(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		status    int
+		authn     *staticAuthenticator
+		decide    func(authorizer.Attributes) (authorizer.Decision, string, error)
+		wantsBody string
+	}{
+		{
+			name:      "401 override",
+			status:    http.StatusUnauthorized,
+			authn:     &staticAuthenticator{},
+			wantsBody: "please present a service account token",
+		},
+		{
+			name:   "403 override",
+			status: http.StatusForbidden,
+			decide: func(authorizer.Attributes) (authorizer.Decision, string, error) {
+				return authorizer.DecisionDeny, "denied", nil
+			},
+			wantsBody: "ask your administrator for access",
+		},
+		{
+			name:   "500 override",
+			status: http.StatusInternalServerError,
+			decide: func(authorizer.Attributes) (authorizer.Decision, string, error) {
+				return authorizer.DecisionNoOpinion, "", errors.New("webhook unavailable")
+			},
+			wantsBody: "temporary failure, retry later",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.ErrorBodies = &ErrorBodyConfig{Overrides: map[string]string{
+				"401": "please present a service account token",
+				"403": "ask your administrator for access",
+				"500": "temporary failure, retry later",
+			}}
+			authn := tc.authn
+			if authn == nil {
+				authn = &staticAuthenticator{u: authenticateAs("jane").u, ok: true}
+			}
+			h := newKubeRBACProxyAuth(authn, &recordingAuthorizer{decide: tc.decide}, cfg)
+
+			rec := httptest.NewRecorder()
+			if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+				t.Fatal("expected the request to be rejected")
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d, got %d", tc.status, rec.Code)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != tc.wantsBody {
+				t.Errorf("expected body %q, got %q", tc.wantsBody, got)
+			}
+		})
+	}
+}
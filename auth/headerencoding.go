@@ -0,0 +1,120 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The supported values for AuthnHeaderConfig.Encoding. Usernames and group
+// names are attacker-influenced (e.g. a certificate CN); placing them in
+// upstream headers verbatim would allow header injection through CR/LF.
+const (
+	// HeaderEncodingSanitize strips control characters from the value.
+	HeaderEncodingSanitize = "sanitize"
+	// HeaderEncodingEncode percent-encodes control characters (and '%') so
+	// that the original value remains recoverable by the upstream.
+	HeaderEncodingEncode = "encode"
+	// HeaderEncodingReject refuses to proxy requests whose identity values
+	// contain control characters.
+	HeaderEncodingReject = "reject"
+)
+
+// encodeHeaderValue applies the configured encoding policy to an identity
+// value before it is placed in an upstream header. The second return value is
+// false when the policy rejects the value.
+func encodeHeaderValue(value, policy string) (string, bool) {
+	if !strings.ContainsFunc(value, isHeaderUnsafe) &&
+		!(policy == HeaderEncodingEncode && strings.ContainsRune(value, '%')) {
+		return value, true
+	}
+
+	switch policy {
+	case HeaderEncodingEncode:
+		var b strings.Builder
+		for _, c := range []byte(value) {
+			if isHeaderUnsafe(rune(c)) || c == '%' {
+				fmt.Fprintf(&b, "%%%02X", c)
+				continue
+			}
+			b.WriteByte(c)
+		}
+		return b.String(), true
+	case HeaderEncodingReject:
+		return "", false
+	default:
+		var b strings.Builder
+		for _, c := range value {
+			if isHeaderUnsafe(c) {
+				continue
+			}
+			b.WriteRune(c)
+		}
+		return b.String(), true
+	}
+}
+
+func isHeaderUnsafe(c rune) bool {
+	return c < 0x20 || c == 0x7f
+}
+
+// StripIdentityHeaders removes the configured identity headers — the user and
+// groups fields and any header carrying the extra-field prefix — so that
+// client-supplied values can never reach the upstream as a forged identity.
+// The prefix match is case-insensitive, mirroring header name semantics.
+func StripIdentityHeaders(h http.Header, headerCfg *AuthnHeaderConfig) {
+	if headerCfg == nil {
+		return
+	}
+	if headerCfg.UserFieldName != "" {
+		h.Del(headerCfg.UserFieldName)
+	}
+	if headerCfg.GroupsFieldName != "" {
+		h.Del(headerCfg.GroupsFieldName)
+	}
+	if prefix := headerCfg.ExtraFieldPrefix; prefix != "" {
+		for name := range h {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				delete(h, name)
+			}
+		}
+	}
+}
+
+// validHeaderName reports whether name is a non-empty RFC 7230 token and can
+// therefore be used as a header field name verbatim.
+func validHeaderName(name string) bool {
+	return name != "" && name == sanitizeHeaderName(name)
+}
+
+// sanitizeHeaderName reduces an arbitrary string (e.g. a user extra key like
+// "authentication.kubernetes.io/scopes") to the RFC 7230 token characters
+// valid in a header field name, dropping everything else.
+func sanitizeHeaderName(name string) string {
+	var b strings.Builder
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			b.WriteRune(c)
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
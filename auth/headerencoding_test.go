@@ -0,0 +1,215 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEncodeHeaderValue(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		value  string
+		policy string
+		want   string
+		wantOK bool
+	}{
+		{name: "clean value passes through", value: "jane", policy: HeaderEncodingSanitize, want: "jane", wantOK: true},
+		{name: "sanitize strips control characters", value: "ja\r\nne", policy: HeaderEncodingSanitize, want: "jane", wantOK: true},
+		{name: "encode percent-encodes control characters", value: "ja\r\nne", policy: HeaderEncodingEncode, want: "ja%0D%0Ane", wantOK: true},
+		{name: "encode escapes literal percent", value: "100%\n", policy: HeaderEncodingEncode, want: "100%25%0A", wantOK: true},
+		{name: "reject refuses unsafe values", value: "ja\r\nne", policy: HeaderEncodingReject, wantOK: false},
+		{name: "reject passes clean values", value: "jane", policy: HeaderEncodingReject, want: "jane", wantOK: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := encodeHeaderValue(tc.value, tc.policy)
+			if ok != tc.wantOK {
+				t.Fatalf("encodeHeaderValue ok = %v, want %v", ok, tc.wantOK)
+			}
+			if ok && got != tc.want {
+				t.Errorf("encodeHeaderValue = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandleEncodesInjectedIdentityHeaders(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authentication.Header.Enabled = true
+	cfg.Authentication.Header.Encoding = HeaderEncodingEncode
+	h := newKubeRBACProxyAuth(authenticateAs("ja\nne", "admins"), &recordingAuthorizer{}, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, req) {
+		t.Fatalf("expected the request to be admitted, got status %d", rec.Code)
+	}
+	if got := req.Header.Get("x-remote-user"); got != "ja%0Ane" {
+		t.Errorf("expected the injected user header to be encoded, got %q", got)
+	}
+	if got := req.Header.Get("x-remote-groups"); got != "admins" {
+		t.Errorf("expected groups header %q, got %q", "admins", got)
+	}
+}
+
+func TestHandleRejectsUnsafeIdentityUnderRejectPolicy(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authentication.Header.Enabled = true
+	cfg.Authentication.Header.Encoding = HeaderEncodingReject
+	h := newKubeRBACProxyAuth(authenticateAs("ja\r\nne"), &recordingAuthorizer{}, cfg)
+
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Error("expected a request with an unsafe identity value to be rejected")
+	}
+}
+
+func TestStripIdentityHeaders(t *testing.T) {
+	headerCfg := &AuthnHeaderConfig{
+		UserFieldName:    "x-remote-user",
+		GroupsFieldName:  "x-remote-groups",
+		ExtraFieldPrefix: "x-remote-extra-",
+	}
+
+	h := http.Header{}
+	h.Set("x-remote-user", "forged")
+	h.Set("x-remote-groups", "system:masters")
+	h.Set("X-Remote-Extra-Scopes", "admin")
+	h.Set("x-REMOTE-extra-tenant", "other")
+	h.Set("Authorization", "Bearer token")
+	h.Set("X-Unrelated", "kept")
+
+	StripIdentityHeaders(h, headerCfg)
+
+	for _, name := range []string{"x-remote-user", "x-remote-groups", "X-Remote-Extra-Scopes", "x-REMOTE-extra-tenant"} {
+		if got := h.Get(name); got != "" {
+			t.Errorf("expected %s to be stripped, got %q", name, got)
+		}
+	}
+	if got := h.Get("Authorization"); got != "Bearer token" {
+		t.Errorf("expected the Authorization header to be kept, got %q", got)
+	}
+	if got := h.Get("X-Unrelated"); got != "kept" {
+		t.Errorf("expected unrelated headers to be kept, got %q", got)
+	}
+}
+
+func TestHandleStripsForgedIdentityHeaders(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authentication.Header.ExtraFieldPrefix = "x-remote-extra-"
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), &recordingAuthorizer{}, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("x-remote-user", "forged")
+	req.Header.Set("X-Remote-Extra-Scopes", "admin")
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, req) {
+		t.Fatalf("expected the request to be admitted, got status %d", rec.Code)
+	}
+	if got := req.Header.Get("x-remote-user"); got != "" {
+		t.Errorf("expected the forged user header to be stripped, got %q", got)
+	}
+	if got := req.Header.Get("X-Remote-Extra-Scopes"); got != "" {
+		t.Errorf("expected the forged extra header to be stripped, got %q", got)
+	}
+}
+
+func TestAuthnConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		header  *AuthnHeaderConfig
+		wantErr bool
+	}{
+		{
+			name:   "nil header config",
+			header: nil,
+		},
+		{
+			name: "disabled injection skips validation",
+			header: &AuthnHeaderConfig{
+				Enabled:       false,
+				UserFieldName: "not a header name",
+			},
+		},
+		{
+			name: "valid configuration",
+			header: &AuthnHeaderConfig{
+				Enabled:          true,
+				UserFieldName:    "x-remote-user",
+				GroupsFieldName:  "x-remote-groups",
+				ExtraFieldPrefix: "x-remote-extra-",
+				GroupSeparator:   "|",
+			},
+		},
+		{
+			name: "missing field names",
+			header: &AuthnHeaderConfig{
+				Enabled:       true,
+				UserFieldName: "x-remote-user",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid user field name",
+			header: &AuthnHeaderConfig{
+				Enabled:         true,
+				UserFieldName:   "x-remote user",
+				GroupsFieldName: "x-remote-groups",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid extra field prefix",
+			header: &AuthnHeaderConfig{
+				Enabled:          true,
+				UserFieldName:    "x-remote-user",
+				GroupsFieldName:  "x-remote-groups",
+				ExtraFieldPrefix: "x-remote:extra-",
+			},
+			wantErr: true,
+		},
+		{
+			name: "control character in group separator",
+			header: &AuthnHeaderConfig{
+				Enabled:         true,
+				UserFieldName:   "x-remote-user",
+				GroupsFieldName: "x-remote-groups",
+				GroupSeparator:  "\r\n",
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &AuthnConfig{Header: tc.header}
+			err := cfg.Validate()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildAuthHandlerSurfacesHeaderConfigErrors(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authentication.Header.Enabled = true
+	cfg.Authentication.Header.UserFieldName = "x-remote\nuser"
+	if _, err := BuildAuthHandler(allowAllKubeClient("unused"), cfg); err == nil {
+		t.Error("expected an invalid header field name to fail the constructor")
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	authenticationv1beta1 "k8s.io/api/authentication/v1beta1"
+	authorizationv1beta1 "k8s.io/api/authorization/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestHealthyWithReachableBackends(t *testing.T) {
+	h, err := BuildAuthHandler(allowAllKubeClient("probe"), testConfig())
+	if err != nil {
+		t.Fatalf("unexpected handler error: %v", err)
+	}
+	if err := h.Healthy(context.Background()); err != nil {
+		t.Errorf("expected the self-checks to pass, got %v", err)
+	}
+}
+
+func TestHealthyReportsBackendFailure(t *testing.T) {
+	client := allowAllKubeClient("probe")
+	client.PrependReactor("create", "subjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, &authorizationv1beta1.SubjectAccessReview{}, errors.New("the server is currently unable to handle the request")
+	})
+
+	h, err := BuildAuthHandler(client, testConfig())
+	if err != nil {
+		t.Fatalf("unexpected handler error: %v", err)
+	}
+	err = h.Healthy(context.Background())
+	if err == nil {
+		t.Fatal("expected the failing SubjectAccessReview probe to surface an error")
+	}
+	if !strings.Contains(err.Error(), "SubjectAccessReview") {
+		t.Errorf("expected the error to name the failing probe, got %v", err)
+	}
+}
+
+func TestHealthyHonorsContextDeadline(t *testing.T) {
+	client := allowAllKubeClient("probe")
+	client.PrependReactor("create", "tokenreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		time.Sleep(5 * time.Second)
+		return true, &authenticationv1beta1.TokenReview{}, nil
+	})
+
+	h, err := BuildAuthHandler(client, testConfig())
+	if err != nil {
+		t.Fatalf("unexpected handler error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := h.Healthy(ctx); err == nil {
+		t.Error("expected a hanging backend to fail the self-check via the context")
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+
+	"github.com/brancz/kube-rbac-proxy/metrics"
+)
+
+// expiryAwareAuthenticator caps cached authentication results at the
+// presenting token's own expiry: a token whose exp claim has passed is routed
+// to the uncached authenticator for revalidation, even while its cache entry
+// would still be served. Every forced revalidation is counted in metrics.
+type expiryAwareAuthenticator struct {
+	cached   authenticator.Request
+	uncached authenticator.Request
+}
+
+func (a *expiryAwareAuthenticator) AuthenticateRequest(req *http.Request) (user.Info, bool, error) {
+	if exp, ok := BearerTokenExpiry(req); ok && !exp.After(time.Now()) {
+		metrics.RecordForcedRevalidation()
+		return a.uncached.AuthenticateRequest(req)
+	}
+	return a.cached.AuthenticateRequest(req)
+}
+
+// BearerTokenExpiry extracts the expiry claim from the request's bearer
+// token, when the token is a JWT carrying one. The token's signature is NOT
+// verified here — validating credentials is the authenticator's job; the
+// claim is only read to bound the lifetime of long-lived connections by the
+// token's own expiry. The second return value is false when the request has
+// no bearer token, the token is not a JWT, or it carries no expiry.
+func BearerTokenExpiry(req *http.Request) (time.Time, bool) {
+	return tokenExpiry(bearerToken(req))
+}
+
+func tokenExpiry(token string) (time.Time, bool) {
+	payload, ok := tokenPayload(token)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
+
+// tokenAudiences returns the aud claim of a JWT, which may be either a single
+// string or an array of strings. The second return value is false when the
+// token is not a JWT or carries no aud claim.
+func tokenAudiences(token string) ([]string, bool) {
+	payload, ok := tokenPayload(token)
+	if !ok {
+		return nil, false
+	}
+
+	var claims struct {
+		Aud json.RawMessage `json:"aud"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || len(claims.Aud) == 0 {
+		return nil, false
+	}
+
+	var single string
+	if err := json.Unmarshal(claims.Aud, &single); err == nil {
+		return []string{single}, true
+	}
+	var multiple []string
+	if err := json.Unmarshal(claims.Aud, &multiple); err == nil && len(multiple) > 0 {
+		return multiple, true
+	}
+	return nil, false
+}
+
+// tokenScopes returns the OAuth2 scopes of a JWT, read from the standard
+// space-delimited scope claim or, failing that, from an scp claim carrying
+// either an array or a space-delimited string. The second return value is
+// false when the token is not a JWT or carries neither claim.
+func tokenScopes(token string) ([]string, bool) {
+	payload, ok := tokenPayload(token)
+	if !ok {
+		return nil, false
+	}
+
+	var claims struct {
+		Scope string          `json:"scope"`
+		Scp   json.RawMessage `json:"scp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, false
+	}
+
+	if claims.Scope != "" {
+		return strings.Fields(claims.Scope), true
+	}
+	if len(claims.Scp) > 0 {
+		var multiple []string
+		if err := json.Unmarshal(claims.Scp, &multiple); err == nil {
+			return multiple, true
+		}
+		var single string
+		if err := json.Unmarshal(claims.Scp, &single); err == nil {
+			return strings.Fields(single), true
+		}
+	}
+	return nil, false
+}
+
+// tokenPayload decodes the claims section of a JWT without verifying its
+// signature.
+func tokenPayload(token string) ([]byte, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, false
+	}
+	return payload, true
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// testJWT assembles an unsigned JWT with the given claims. The signature is
+// irrelevant here — the claim readers never verify it.
+func testJWT(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+}
+
+func TestTokenExpiry(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	got, ok := tokenExpiry(testJWT(t, map[string]interface{}{"exp": exp}))
+	if !ok || got.Unix() != exp {
+		t.Errorf("expected the exp claim to be read, got %v ok=%v", got, ok)
+	}
+
+	for _, token := range []string{"", "not-a-jwt", testJWT(t, map[string]interface{}{"sub": "jane"})} {
+		if _, ok := tokenExpiry(token); ok {
+			t.Errorf("expected no expiry for token %q", token)
+		}
+	}
+}
+
+func TestExpiryAwareAuthenticatorForcesRevalidation(t *testing.T) {
+	cached := &countingAuthenticator{staticAuthenticator: staticAuthenticator{u: &user.DefaultInfo{Name: "cached"}, ok: true}}
+	uncached := &countingAuthenticator{staticAuthenticator: staticAuthenticator{u: &user.DefaultInfo{Name: "uncached"}, ok: true}}
+	a := &expiryAwareAuthenticator{cached: cached, uncached: uncached}
+
+	expired := bearerRequest(testJWT(t, map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}))
+	if u, _, _ := a.AuthenticateRequest(expired); u.GetName() != "uncached" {
+		t.Errorf("expected an expired token to be revalidated uncached, got %q", u.GetName())
+	}
+
+	fresh := bearerRequest(testJWT(t, map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()}))
+	if u, _, _ := a.AuthenticateRequest(fresh); u.GetName() != "cached" {
+		t.Errorf("expected a fresh token to use the cache, got %q", u.GetName())
+	}
+
+	opaque := bearerRequest("opaque-token")
+	if u, _, _ := a.AuthenticateRequest(opaque); u.GetName() != "cached" {
+		t.Errorf("expected a non-JWT token to use the cache, got %q", u.GetName())
+	}
+}
+
+func TestAudienceValidatingAuthenticator(t *testing.T) {
+	delegate := &countingAuthenticator{staticAuthenticator: staticAuthenticator{u: &user.DefaultInfo{Name: "jane"}, ok: true}}
+	a := &audienceValidatingAuthenticator{delegate: delegate, audiences: []string{"kube-rbac-proxy"}}
+
+	matching := bearerRequest(testJWT(t, map[string]interface{}{"aud": "kube-rbac-proxy"}))
+	if _, ok, err := a.AuthenticateRequest(matching); !ok || err != nil {
+		t.Errorf("expected a matching audience to authenticate, got ok=%v err=%v", ok, err)
+	}
+
+	mismatched := bearerRequest(testJWT(t, map[string]interface{}{"aud": []string{"other-service"}}))
+	if _, ok, err := a.AuthenticateRequest(mismatched); ok || err == nil {
+		t.Errorf("expected a mismatched audience to be rejected, got ok=%v err=%v", ok, err)
+	}
+
+	// Legacy unscoped tokens carry no aud claim and pass through.
+	legacy := bearerRequest(testJWT(t, map[string]interface{}{"sub": "jane"}))
+	if _, ok, err := a.AuthenticateRequest(legacy); !ok || err != nil {
+		t.Errorf("expected an aud-less token to reach the delegate, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		claims map[string]interface{}
+		want   []string
+		wantOK bool
+	}{
+		{name: "space-delimited scope", claims: map[string]interface{}{"scope": "read write"}, want: []string{"read", "write"}, wantOK: true},
+		{name: "scp array", claims: map[string]interface{}{"scp": []string{"read", "write"}}, want: []string{"read", "write"}, wantOK: true},
+		{name: "scp string", claims: map[string]interface{}{"scp": "read write"}, want: []string{"read", "write"}, wantOK: true},
+		{name: "no scopes", claims: map[string]interface{}{"sub": "jane"}, wantOK: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := tokenScopes(testJWT(t, tc.claims))
+			if ok != tc.wantOK {
+				t.Fatalf("tokenScopes ok = %v, want %v", ok, tc.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("tokenScopes = %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("tokenScopes = %v, want %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"fmt"
+
+	authorizationapi "k8s.io/api/authorization/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	authorizationclient "k8s.io/client-go/kubernetes/typed/authorization/v1beta1"
+)
+
+// localSARAttributes marks an attribute record, produced by a path rule with
+// useLocalSubjectAccessReview, to be authorized with a namespace-scoped
+// LocalSubjectAccessReview instead of a cluster-scoped SubjectAccessReview.
+type localSARAttributes struct {
+	authorizer.AttributesRecord
+}
+
+// isLocalSAR reports whether an attribute record asks for the
+// LocalSubjectAccessReview variant.
+func isLocalSAR(attrs authorizer.Attributes) bool {
+	_, ok := attrs.(localSARAttributes)
+	return ok
+}
+
+// localSubjectAccessReviewAuthorizer authorizes via namespace-scoped
+// LocalSubjectAccessReviews, so the proxy only needs permission to create
+// them in the namespaces its path rules reference, instead of cluster-wide
+// SubjectAccessReview access. Decisions are not cached; each check is a round
+// trip to the API server.
+type localSubjectAccessReviewAuthorizer struct {
+	client authorizationclient.LocalSubjectAccessReviewsGetter
+}
+
+func (a *localSubjectAccessReviewAuthorizer) Authorize(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	namespace := attrs.GetNamespace()
+	if !attrs.IsResourceRequest() || namespace == "" {
+		return authorizer.DecisionNoOpinion, "", fmt.Errorf("local SubjectAccessReview requires a namespaced resource request")
+	}
+
+	u := attrs.GetUser()
+	var extra map[string]authorizationapi.ExtraValue
+	if len(u.GetExtra()) > 0 {
+		extra = map[string]authorizationapi.ExtraValue{}
+		for k, v := range u.GetExtra() {
+			extra[k] = authorizationapi.ExtraValue(v)
+		}
+	}
+
+	review := &authorizationapi.LocalSubjectAccessReview{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace},
+		Spec: authorizationapi.SubjectAccessReviewSpec{
+			User:   u.GetName(),
+			Groups: u.GetGroups(),
+			Extra:  extra,
+			ResourceAttributes: &authorizationapi.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        attrs.GetVerb(),
+				Group:       attrs.GetAPIGroup(),
+				Version:     attrs.GetAPIVersion(),
+				Resource:    attrs.GetResource(),
+				Subresource: attrs.GetSubresource(),
+				Name:        attrs.GetName(),
+			},
+		},
+	}
+
+	response, err := a.client.LocalSubjectAccessReviews(namespace).Create(review)
+	if err != nil {
+		return authorizer.DecisionNoOpinion, "", err
+	}
+
+	if response.Status.Allowed {
+		return authorizer.DecisionAllow, response.Status.Reason, nil
+	}
+	if response.Status.Denied {
+		return authorizer.DecisionDeny, response.Status.Reason, nil
+	}
+	return authorizer.DecisionNoOpinion, response.Status.Reason, nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authorizationv1beta1 "k8s.io/api/authorization/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestHandleUsesLocalSubjectAccessReviewForConfiguredRules(t *testing.T) {
+	client := allowAllKubeClient("jane")
+	var localNamespaces []string
+	client.PrependReactor("create", "localsubjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		localNamespaces = append(localNamespaces, action.GetNamespace())
+		return true, &authorizationv1beta1.LocalSubjectAccessReview{
+			Status: authorizationv1beta1.SubjectAccessReviewStatus{Allowed: true},
+		}, nil
+	})
+	clusterSARs := 0
+	client.PrependReactor("create", "subjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		clusterSARs++
+		return true, &authorizationv1beta1.SubjectAccessReview{
+			Status: authorizationv1beta1.SubjectAccessReviewStatus{Allowed: true},
+		}, nil
+	})
+
+	cfg := testConfig()
+	cfg.Authorization.PathRules = []PathAuthorizationRule{{
+		Path:               "/api/*",
+		UseLocalSAR:        true,
+		ResourceAttributes: &ResourceAttributes{Namespace: "tenant-a", Resource: "services"},
+	}}
+
+	h, err := BuildAuthHandler(client, cfg)
+	if err != nil {
+		t.Fatalf("unexpected handler error: %v", err)
+	}
+
+	req := bearerRequest("token")
+	req.URL.Path = "/api/v1/services"
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, req) {
+		t.Fatalf("expected the request to be admitted, got status %d", rec.Code)
+	}
+	// The self-authorization of the proxied request must go through the
+	// rule's namespace, not the cluster scope.
+	if len(localNamespaces) != 1 || localNamespaces[0] != "tenant-a" {
+		t.Errorf("expected one LocalSubjectAccessReview in tenant-a, got %v", localNamespaces)
+	}
+	if clusterSARs != 0 {
+		t.Errorf("expected no cluster-scoped SubjectAccessReview, got %d", clusterSARs)
+	}
+}
+
+func TestHandleLocalSubjectAccessReviewDenies(t *testing.T) {
+	client := allowAllKubeClient("jane")
+	client.PrependReactor("create", "localsubjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, &authorizationv1beta1.LocalSubjectAccessReview{
+			Status: authorizationv1beta1.SubjectAccessReviewStatus{Allowed: false, Reason: "no RoleBinding"},
+		}, nil
+	})
+
+	cfg := testConfig()
+	cfg.Authorization.PathRules = []PathAuthorizationRule{{
+		Path:               "/api/*",
+		UseLocalSAR:        true,
+		ResourceAttributes: &ResourceAttributes{Namespace: "tenant-a", Resource: "services"},
+	}}
+
+	h, err := BuildAuthHandler(client, cfg)
+	if err != nil {
+		t.Fatalf("unexpected handler error: %v", err)
+	}
+
+	req := bearerRequest("token")
+	req.URL.Path = "/api/v1/services"
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, req) {
+		t.Error("expected a denied LocalSubjectAccessReview to reject the request")
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+}
+
+func TestLocalSARAuthorizerRequiresNamespacedResource(t *testing.T) {
+	a := &localSubjectAccessReviewAuthorizer{client: allowAllKubeClient("unused").AuthorizationV1beta1()}
+
+	for _, attrs := range []authorizer.AttributesRecord{
+		{User: &user.DefaultInfo{Name: "jane"}, Verb: "get", Path: "/healthz"},
+		{User: &user.DefaultInfo{Name: "jane"}, Verb: "get", Resource: "services", ResourceRequest: true},
+	} {
+		if _, _, err := a.Authorize(attrs); err == nil {
+			t.Errorf("expected an error for non-namespaced attributes %#v", attrs)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// Logger is the interface the auth handler logs through, so embedding
+// applications can route its output into their own (structured) logger.
+// Both methods take alternating key/value pairs carrying the structured
+// context of the event (user, verb, resource, decision, ...); keys are
+// strings.
+type Logger interface {
+	// Error reports a failure that is not attributable to the client, e.g.
+	// an authorization backend error.
+	Error(msg string, keysAndValues ...interface{})
+	// Info logs an event at the given glog-style verbosity level; higher
+	// levels are more verbose.
+	Info(level int, msg string, keysAndValues ...interface{})
+}
+
+// glogLogger is the default Logger. It renders the key/value pairs as
+// "key=value" suffixes, keeping the output close to the direct glog calls it
+// replaced.
+type glogLogger struct{}
+
+func (glogLogger) Error(msg string, keysAndValues ...interface{}) {
+	glog.ErrorDepth(1, msg+formatKeysAndValues(keysAndValues))
+}
+
+func (glogLogger) Info(level int, msg string, keysAndValues ...interface{}) {
+	if glog.V(glog.Level(level)) {
+		glog.InfoDepth(1, msg+formatKeysAndValues(keysAndValues))
+	}
+}
+
+// formatKeysAndValues renders alternating key/value pairs as " key=value",
+// quoting string values so embedded spaces do not break up the pairs. A
+// trailing key without a value is dropped.
+func formatKeysAndValues(keysAndValues []interface{}) string {
+	var buf bytes.Buffer
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fmt.Fprintf(&buf, " %v=", keysAndValues[i])
+		switch v := keysAndValues[i+1].(type) {
+		case string:
+			fmt.Fprintf(&buf, "%q", v)
+		default:
+			fmt.Fprintf(&buf, "%v", v)
+		}
+	}
+	return buf.String()
+}
+
+// SetLogger routes the handler's per-request log output through the given
+// logger instead of the default glog-backed one. It must be called before the
+// handler starts serving requests; background loops (CA reloading, cache
+// sweeps) keep logging through glog.
+func (h *kubeRBACProxyAuth) SetLogger(l Logger) {
+	h.logger = l
+	h.authorizerAttributesGetter.logger = l
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+func TestFormatKeysAndValues(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		kvs  []interface{}
+		want string
+	}{
+		{name: "empty", kvs: nil, want: ""},
+		{name: "string values are quoted", kvs: []interface{}{"user", "ja ne"}, want: ` user="ja ne"`},
+		{name: "non-string values are plain", kvs: []interface{}{"count", 3}, want: " count=3"},
+		{name: "multiple pairs", kvs: []interface{}{"user", "jane", "verb", "get"}, want: ` user="jane" verb="get"`},
+		{name: "trailing key without value is dropped", kvs: []interface{}{"user", "jane", "dangling"}, want: ` user="jane"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := formatKeysAndValues(tc.kvs); got != tc.want {
+				t.Errorf("formatKeysAndValues(%v) = %q, want %q", tc.kvs, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSetLoggerRoutesHandleOutput(t *testing.T) {
+	authz := &recordingAuthorizer{
+		decide: func(authorizer.Attributes) (authorizer.Decision, string, error) {
+			return authorizer.DecisionDeny, "RBAC denied", nil
+		},
+	}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, testConfig())
+	logger := &capturingLogger{}
+	h.SetLogger(logger)
+
+	if h.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Fatal("expected the denied request to be rejected")
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	found := false
+	for _, line := range logger.infos {
+		if strings.Contains(line, "Forbidden") && strings.Contains(line, `user="jane"`) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected the denial to be logged through the custom logger, got %v", logger.infos)
+	}
+	if len(logger.errors) != 0 {
+		t.Errorf("expected no error-level output for a plain denial, got %v", logger.errors)
+	}
+}
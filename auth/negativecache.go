@@ -0,0 +1,137 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// negativeCacheMaxEntries bounds the number of cached failures so that a
+// flood of distinct invalid tokens cannot grow the cache without limit.
+const negativeCacheMaxEntries = 4096
+
+// negativeCachingAuthenticator wraps an authenticator and remembers
+// authentication failures for a short TTL, keyed on a hash of the presented
+// credentials. A client retrying an invalid token (e.g. a scraper with an
+// expired token retrying every second) is then short-circuited without
+// another TokenReview round trip. Transient backend errors are never cached.
+type negativeCachingAuthenticator struct {
+	delegate authenticator.Request
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+func newNegativeCachingAuthenticator(delegate authenticator.Request, ttl time.Duration) *negativeCachingAuthenticator {
+	return &negativeCachingAuthenticator{
+		delegate: delegate,
+		ttl:      ttl,
+		entries:  map[string]time.Time{},
+	}
+}
+
+func (a *negativeCachingAuthenticator) AuthenticateRequest(req *http.Request) (user.Info, bool, error) {
+	key, ok := negativeCacheKey(req)
+	if !ok {
+		return a.delegate.AuthenticateRequest(req)
+	}
+
+	now := time.Now()
+
+	a.mu.Lock()
+	expiry, cached := a.entries[key]
+	if cached {
+		if now.Before(expiry) {
+			a.mu.Unlock()
+			return nil, false, nil
+		}
+		delete(a.entries, key)
+	}
+	a.mu.Unlock()
+
+	u, authenticated, err := a.delegate.AuthenticateRequest(req)
+	if err == nil && !authenticated {
+		a.mu.Lock()
+		if len(a.entries) >= negativeCacheMaxEntries {
+			a.evictExpired(now)
+		}
+		if len(a.entries) < negativeCacheMaxEntries {
+			a.entries[key] = now.Add(a.ttl)
+		}
+		a.mu.Unlock()
+	}
+
+	return u, authenticated, err
+}
+
+// sweep periodically drops expired failure entries, so that cached failures
+// for tokens that are never presented again do not linger until the cache
+// fills up. Entries are only ever served before their expiry, so a token that
+// becomes valid is revalidated as soon as its failure entry's TTL has passed,
+// regardless of sweep timing. Like reloadableCertPool.watch, the sweep runs
+// for the lifetime of the process.
+func (a *negativeCachingAuthenticator) sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		a.mu.Lock()
+		a.evictExpired(time.Now())
+		a.mu.Unlock()
+	}
+}
+
+// evictExpired must be called with the lock held.
+func (a *negativeCachingAuthenticator) evictExpired(now time.Time) {
+	for key, expiry := range a.entries {
+		if now.After(expiry) {
+			delete(a.entries, key)
+		}
+	}
+}
+
+// pathCacheBypassAuthenticator routes requests for configured paths to an
+// uncached authenticator so that sensitive endpoints revalidate credentials
+// on every request, while all other requests use the cached authenticator.
+type pathCacheBypassAuthenticator struct {
+	cached   authenticator.Request
+	uncached authenticator.Request
+	paths    []string
+}
+
+func (a *pathCacheBypassAuthenticator) AuthenticateRequest(req *http.Request) (user.Info, bool, error) {
+	if pathMatches(req.URL.Path, a.paths) {
+		return a.uncached.AuthenticateRequest(req)
+	}
+	return a.cached.AuthenticateRequest(req)
+}
+
+// negativeCacheKey derives the cache key from the presented credentials. Only
+// the Authorization header is considered; requests without one (e.g. client
+// certificates) are not cached.
+func negativeCacheKey(req *http.Request) (string, bool) {
+	authz := req.Header.Get("Authorization")
+	if authz == "" {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(authz))
+	return string(sum[:]), true
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// countingAuthenticator counts delegate invocations on top of a fixed result.
+type countingAuthenticator struct {
+	staticAuthenticator
+	calls int
+}
+
+func (a *countingAuthenticator) AuthenticateRequest(req *http.Request) (user.Info, bool, error) {
+	a.calls++
+	return a.staticAuthenticator.AuthenticateRequest(req)
+}
+
+func bearerRequest(token string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestNegativeCachingAuthenticatorShortCircuitsRepeatedFailures(t *testing.T) {
+	delegate := &countingAuthenticator{}
+	a := newNegativeCachingAuthenticator(delegate, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if _, ok, err := a.AuthenticateRequest(bearerRequest("bad-token")); ok || err != nil {
+			t.Fatalf("expected a cached failure, got ok=%v err=%v", ok, err)
+		}
+	}
+	if delegate.calls != 1 {
+		t.Errorf("expected one delegate call for a repeated invalid token, got %d", delegate.calls)
+	}
+
+	// A different token misses the cache and hits the delegate.
+	a.AuthenticateRequest(bearerRequest("other-token"))
+	if delegate.calls != 2 {
+		t.Errorf("expected a distinct token to reach the delegate, got %d calls", delegate.calls)
+	}
+}
+
+func TestNegativeCachingAuthenticatorDoesNotCacheErrors(t *testing.T) {
+	delegate := &countingAuthenticator{staticAuthenticator: staticAuthenticator{err: errors.New("backend unavailable")}}
+	a := newNegativeCachingAuthenticator(delegate, time.Minute)
+
+	a.AuthenticateRequest(bearerRequest("some-token"))
+	a.AuthenticateRequest(bearerRequest("some-token"))
+	if delegate.calls != 2 {
+		t.Errorf("expected transient errors not to be cached, got %d delegate calls", delegate.calls)
+	}
+}
+
+func TestNegativeCachingAuthenticatorIgnoresRequestsWithoutCredentials(t *testing.T) {
+	delegate := &countingAuthenticator{}
+	a := newNegativeCachingAuthenticator(delegate, time.Minute)
+
+	a.AuthenticateRequest(httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	a.AuthenticateRequest(httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if delegate.calls != 2 {
+		t.Errorf("expected requests without an Authorization header to bypass the cache, got %d delegate calls", delegate.calls)
+	}
+}
+
+func TestNegativeCachingAuthenticatorExpiresEntries(t *testing.T) {
+	delegate := &countingAuthenticator{}
+	a := newNegativeCachingAuthenticator(delegate, time.Millisecond)
+
+	a.AuthenticateRequest(bearerRequest("bad-token"))
+	time.Sleep(5 * time.Millisecond)
+	a.AuthenticateRequest(bearerRequest("bad-token"))
+	if delegate.calls != 2 {
+		t.Errorf("expected the failure entry to expire after its TTL, got %d delegate calls", delegate.calls)
+	}
+}
+
+func TestPathCacheBypassAuthenticatorRoutesByPath(t *testing.T) {
+	cached := &countingAuthenticator{staticAuthenticator: staticAuthenticator{u: &user.DefaultInfo{Name: "cached"}, ok: true}}
+	uncached := &countingAuthenticator{staticAuthenticator: staticAuthenticator{u: &user.DefaultInfo{Name: "uncached"}, ok: true}}
+	a := &pathCacheBypassAuthenticator{
+		cached:   cached,
+		uncached: uncached,
+		paths:    []string{"/debug/*"},
+	}
+
+	u, _, _ := a.AuthenticateRequest(httptest.NewRequest(http.MethodGet, "/debug/pprof", nil))
+	if u.GetName() != "uncached" {
+		t.Errorf("expected the bypass path to hit the uncached authenticator, got %q", u.GetName())
+	}
+	u, _, _ = a.AuthenticateRequest(httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if u.GetName() != "cached" {
+		t.Errorf("expected other paths to hit the cached authenticator, got %q", u.GetName())
+	}
+	if cached.calls != 1 || uncached.calls != 1 {
+		t.Errorf("expected one call each, got cached=%d uncached=%d", cached.calls, uncached.calls)
+	}
+}
+
+func TestBuildAuthHandlerRejectsNegativeFailureCacheTTL(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authentication.FailureCacheTTL = -time.Minute
+	if _, err := BuildAuthHandler(allowAllKubeClient("unused"), cfg); err == nil {
+		t.Error("expected a negative failure cache TTL to be rejected at build time")
+	}
+}
+
+func TestNegativeCacheSweepEvictsExpiredEntries(t *testing.T) {
+	delegate := &countingAuthenticator{}
+	a := newNegativeCachingAuthenticator(delegate, 10*time.Millisecond)
+
+	if _, ok, _ := a.AuthenticateRequest(bearerRequest("bad-token")); ok {
+		t.Fatal("expected the delegate to reject the token")
+	}
+	a.mu.Lock()
+	entries := len(a.entries)
+	a.mu.Unlock()
+	if entries != 1 {
+		t.Fatalf("expected one cached failure, got %d", entries)
+	}
+
+	go a.sweep(5 * time.Millisecond)
+
+	// The sweep drops the entry once its TTL has passed, even though the
+	// token is never presented again.
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		a.mu.Lock()
+		entries = len(a.entries)
+		a.mu.Unlock()
+		if entries == 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("expected the sweep to evict the expired failure entry")
+}
+
+func TestNegativeCacheBoundsItsSize(t *testing.T) {
+	delegate := &countingAuthenticator{}
+	a := newNegativeCachingAuthenticator(delegate, time.Hour)
+
+	// Flood the cache past its bound with distinct invalid credentials; the
+	// entry count must never exceed the limit.
+	for i := 0; i < negativeCacheMaxEntries+10; i++ {
+		a.AuthenticateRequest(bearerRequest(fmt.Sprintf("bad-token-%d", i)))
+	}
+	a.mu.Lock()
+	entries := len(a.entries)
+	a.mu.Unlock()
+	if entries > negativeCacheMaxEntries {
+		t.Errorf("expected at most %d cached failures, got %d", negativeCacheMaxEntries, entries)
+	}
+}
@@ -0,0 +1,42 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"path"
+	"strings"
+)
+
+// pathMatches reports whether the (normalized) request path matches one of
+// the patterns. A pattern is either an exact path or a prefix ending in '*'.
+// The request path is cleaned first so that traversal tricks such as
+// "/metrics/../secure" cannot be used to slip past a pattern.
+func pathMatches(requestPath string, patterns []string) bool {
+	normalized := path.Clean("/" + requestPath)
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(normalized, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+			continue
+		}
+		if normalized == pattern {
+			return true
+		}
+	}
+	return false
+}
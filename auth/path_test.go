@@ -0,0 +1,76 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPathMatches(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		path     string
+		patterns []string
+		want     bool
+	}{
+		{name: "exact match", path: "/healthz", patterns: []string{"/healthz"}, want: true},
+		{name: "no match", path: "/metrics", patterns: []string{"/healthz"}, want: false},
+		{name: "prefix pattern", path: "/debug/pprof/heap", patterns: []string{"/debug/*"}, want: true},
+		{name: "prefix pattern misses sibling", path: "/debugging", patterns: []string{"/debug/*"}, want: false},
+		{name: "traversal is normalized", path: "/healthz/../metrics", patterns: []string{"/healthz"}, want: false},
+		{name: "redundant slashes are normalized", path: "//healthz", patterns: []string{"/healthz"}, want: true},
+		{name: "empty patterns", path: "/healthz", patterns: nil, want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := pathMatches(tc.path, tc.patterns); got != tc.want {
+				t.Errorf("pathMatches(%q, %v) = %v, want %v", tc.path, tc.patterns, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandleIgnoresConfiguredPaths(t *testing.T) {
+	cfg := testConfig()
+	cfg.IgnorePaths = []string{"/healthz"}
+	authz := &recordingAuthorizer{}
+	// The authenticator rejects everything: only the ignore list can admit.
+	h := newKubeRBACProxyAuth(&staticAuthenticator{}, authz, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	req.Header.Set("x-remote-user", "forged")
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, req) {
+		t.Fatalf("expected the ignored path to be proxied through, got status %d", rec.Code)
+	}
+	if len(authz.recorded()) != 0 {
+		t.Error("expected no authorization for an ignored path")
+	}
+	if got := req.Header.Get("x-remote-user"); got != "" {
+		t.Errorf("expected identity headers to be stripped on ignored paths, got %q", got)
+	}
+
+	// A traversal into the ignored prefix must not bypass auth.
+	rec = httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/healthz/../metrics", nil)) {
+		t.Error("expected a traversal out of the ignored path to require auth")
+	}
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Reloader serializes configuration reloads so that concurrent file changes
+// (CA bundle, serving certificate, auth configuration) cannot produce an
+// inconsistent combined state, e.g. a new CA applied together with a stale
+// authorization configuration. All registered reload functions run one at a
+// time and in registration order.
+//
+// A reload function must be atomic itself: it either swaps its complete new
+// state in (typically via an atomic value) or returns an error and leaves the
+// previous state untouched.
+type Reloader struct {
+	mu    sync.Mutex
+	funcs []namedReload
+}
+
+type namedReload struct {
+	name   string
+	reload func() error
+}
+
+func NewReloader() *Reloader {
+	return &Reloader{}
+}
+
+// Register adds a named reload function. Registration order determines
+// execution order.
+func (r *Reloader) Register(name string, reload func() error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.funcs = append(r.funcs, namedReload{name: name, reload: reload})
+}
+
+// Reload runs all registered reload functions serially. A failing function
+// does not stop the remaining ones; all failures are reported in the
+// returned error. Concurrent callers are serialized.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var errs []error
+	for _, f := range r.funcs {
+		if err := f.reload(); err != nil {
+			glog.Errorf("Reload of %q failed, keeping previous state: %v", f.name, err)
+			errs = append(errs, fmt.Errorf("%s: %v", f.name, err))
+			continue
+		}
+		glog.V(4).Infof("Reloaded %q", f.name)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d reload(s) failed: %v", len(errs), errs)
+	}
+	return nil
+}
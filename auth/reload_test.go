@@ -0,0 +1,217 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSignedCAPEM generates a throwaway CA certificate for reload tests and
+// returns its PEM encoding.
+func selfSignedCAPEM(t *testing.T, commonName string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// writeTempCA writes pemBytes to a fresh temp file and returns its path.
+func writeTempCA(t *testing.T, pemBytes []byte) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "kube-rbac-proxy-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(path, pemBytes, 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReloaderRunsRegisteredReloads(t *testing.T) {
+	r := NewReloader()
+	calls := 0
+	r.Register("first", func() error {
+		calls++
+		return nil
+	})
+	r.Register("second", func() error {
+		calls++
+		return nil
+	})
+
+	if err := r.Reload(); err != nil {
+		t.Fatalf("unexpected reload error: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected both registered reloads to run, got %d", calls)
+	}
+}
+
+func TestReloaderAggregatesFailures(t *testing.T) {
+	r := NewReloader()
+	secondRan := false
+	r.Register("broken bundle", func() error {
+		return errors.New("no valid certificates")
+	})
+	r.Register("working bundle", func() error {
+		secondRan = true
+		return nil
+	})
+
+	err := r.Reload()
+	if err == nil {
+		t.Fatal("expected the failing reload to surface an error")
+	}
+	if !strings.Contains(err.Error(), "broken bundle") {
+		t.Errorf("expected the error to name the failing registration, got %v", err)
+	}
+	if !secondRan {
+		t.Error("expected a failing reload not to stop the remaining ones")
+	}
+}
+
+func TestReloadableCertPoolPicksUpRotatedBundle(t *testing.T) {
+	path := writeTempCA(t, selfSignedCAPEM(t, "ca-one"))
+	defer os.RemoveAll(filepath.Dir(path))
+
+	pool, err := newReloadableCertPool(path)
+	if err != nil {
+		t.Fatalf("unexpected constructor error: %v", err)
+	}
+	before := pool.current()
+
+	if err := ioutil.WriteFile(path, selfSignedCAPEM(t, "ca-two"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.reload(); err != nil {
+		t.Fatalf("unexpected reload error: %v", err)
+	}
+	if pool.current() == before {
+		t.Error("expected the reload to swap in a pool built from the rotated bundle")
+	}
+}
+
+func TestBuildAuthHandlerRegistersClientCAForReload(t *testing.T) {
+	path := writeTempCA(t, selfSignedCAPEM(t, "client-ca"))
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg := testConfig()
+	cfg.Authentication.X509 = &X509Config{ClientCAFile: path}
+
+	h, err := BuildAuthHandler(allowAllKubeClient("unused"), cfg)
+	if err != nil {
+		t.Fatalf("unexpected handler error: %v", err)
+	}
+	if err := h.Reloader().Reload(); err != nil {
+		t.Errorf("expected the registered CA bundle to reload on demand, got %v", err)
+	}
+
+	// Break the bundle on disk: an on-demand reload now reports the failure.
+	if err := ioutil.WriteFile(path, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Reloader().Reload(); err == nil {
+		t.Error("expected the reload of a broken bundle to surface an error")
+	}
+}
+
+func TestReloadableCertPoolKeepsPreviousPoolOnBadBundle(t *testing.T) {
+	path := writeTempCA(t, selfSignedCAPEM(t, "good-ca"))
+	defer os.RemoveAll(filepath.Dir(path))
+
+	pool, err := newReloadableCertPool(path)
+	if err != nil {
+		t.Fatalf("unexpected constructor error: %v", err)
+	}
+	before := pool.current()
+
+	// A rotation caught mid-write: the file holds no valid certificate.
+	if err := ioutil.WriteFile(path, []byte("-----BEGIN GARBAGE-----"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.reload(); err == nil {
+		t.Error("expected the reload of a broken bundle to report an error")
+	}
+	if pool.current() != before {
+		t.Error("expected the previous pool to stay in place after a failed reload")
+	}
+}
+
+func TestReloadableCertPoolWatchPicksUpRotation(t *testing.T) {
+	path := writeTempCA(t, selfSignedCAPEM(t, "watched-ca"))
+	defer os.RemoveAll(filepath.Dir(path))
+
+	pool, err := newReloadableCertPool(path)
+	if err != nil {
+		t.Fatalf("unexpected constructor error: %v", err)
+	}
+	before := pool.current()
+	go pool.watch(5 * time.Millisecond)
+	// Give the watch loop time to record the current modification time
+	// before rotating underneath it.
+	time.Sleep(50 * time.Millisecond)
+
+	// Rotate the bundle on disk with a fresh modification time.
+	rotated := selfSignedCAPEM(t, "rotated-ca")
+	if err := ioutil.WriteFile(path, rotated, 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if pool.current() != before {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("expected the watch loop to pick up the rotated bundle")
+}
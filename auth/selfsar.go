@@ -0,0 +1,92 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	authorizationapi "k8s.io/api/authorization/v1beta1"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// selfSubjectAccessReviewAuthorizer authorizes by issuing a
+// SelfSubjectAccessReview with the caller's own bearer token instead of a
+// SubjectAccessReview under the proxy's identity.
+//
+// The tradeoff: the proxy no longer needs permission to create
+// SubjectAccessReviews, but every authorization requires a round trip with
+// the client's token (no proxy-side decision caching), and only token-based
+// clients can be authorized in this mode. The caller's token is sent to the
+// API server, which it already trusts by definition.
+type selfSubjectAccessReviewAuthorizer struct {
+	restConfig *rest.Config
+}
+
+// AuthorizeWithToken issues a SelfSubjectAccessReview for the given
+// attributes using the supplied bearer token as the client identity.
+func (a *selfSubjectAccessReviewAuthorizer) AuthorizeWithToken(token string, attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	cfg := rest.AnonymousClientConfig(a.restConfig)
+	cfg.BearerToken = token
+
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return authorizer.DecisionNoOpinion, "", fmt.Errorf("failed to create client for self subject access review: %v", err)
+	}
+
+	ssar := &authorizationapi.SelfSubjectAccessReview{}
+	if attrs.IsResourceRequest() {
+		ssar.Spec.ResourceAttributes = &authorizationapi.ResourceAttributes{
+			Namespace:   attrs.GetNamespace(),
+			Verb:        attrs.GetVerb(),
+			Group:       attrs.GetAPIGroup(),
+			Version:     attrs.GetAPIVersion(),
+			Resource:    attrs.GetResource(),
+			Subresource: attrs.GetSubresource(),
+			Name:        attrs.GetName(),
+		}
+	} else {
+		ssar.Spec.NonResourceAttributes = &authorizationapi.NonResourceAttributes{
+			Path: attrs.GetPath(),
+			Verb: attrs.GetVerb(),
+		}
+	}
+
+	response, err := client.AuthorizationV1beta1().SelfSubjectAccessReviews().Create(ssar)
+	if err != nil {
+		return authorizer.DecisionNoOpinion, "", err
+	}
+
+	if response.Status.Allowed {
+		return authorizer.DecisionAllow, response.Status.Reason, nil
+	}
+	return authorizer.DecisionNoOpinion, response.Status.Reason, nil
+}
+
+// bearerToken extracts the bearer token from the request's Authorization
+// header, returning an empty string when none is present.
+func bearerToken(req *http.Request) string {
+	authz := req.Header.Get("Authorization")
+	parts := strings.SplitN(authz, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return ""
+	}
+	return parts[1]
+}
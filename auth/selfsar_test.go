@@ -0,0 +1,158 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/client-go/rest"
+)
+
+func TestBearerToken(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "bearer token", header: "Bearer some-token", want: "some-token"},
+		{name: "case insensitive scheme", header: "bearer some-token", want: "some-token"},
+		{name: "basic auth", header: "Basic dXNlcjpwYXNz", want: ""},
+		{name: "no header", header: "", want: ""},
+		{name: "scheme only", header: "Bearer", want: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			if got := bearerToken(req); got != tc.want {
+				t.Errorf("bearerToken = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandleRequiresBearerTokenForSelfAuthorization(t *testing.T) {
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, testConfig())
+	h.selfAuthorizer = &selfSubjectAccessReviewAuthorizer{}
+
+	// Authenticated without a token (e.g. a client certificate): self subject
+	// access review authorization has no credential to act as, so the request
+	// is denied without consulting any authorizer.
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, req) {
+		t.Error("expected a tokenless request to be denied in self-authorization mode")
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+	if got := authz.recorded(); len(got) != 0 {
+		t.Errorf("expected the delegating authorizer not to be consulted, got %d calls", len(got))
+	}
+}
+
+func TestHandleSelfAuthorizationSurvivesHeaderConsumingAuthenticator(t *testing.T) {
+	// The production bearer-token authenticator deletes the Authorization
+	// header on success; the self subject access review must still be issued
+	// with the token the client presented.
+	var seenAuthorization string
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenAuthorization = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"kind":"SelfSubjectAccessReview","apiVersion":"authorization.k8s.io/v1beta1","status":{"allowed":true}}`))
+	}))
+	defer apiServer.Close()
+
+	authn := &headerConsumingAuthenticator{delegate: authenticateAs("jane")}
+	h := newKubeRBACProxyAuth(authn, &recordingAuthorizer{}, testConfig())
+	h.selfAuthorizer = &selfSubjectAccessReviewAuthorizer{restConfig: &rest.Config{Host: apiServer.URL}}
+
+	req := bearerRequest("user-token")
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, req) {
+		t.Fatalf("expected the request to be admitted, got status %d", rec.Code)
+	}
+	if seenAuthorization != "Bearer user-token" {
+		t.Errorf("expected the review to carry the client's token, got %q", seenAuthorization)
+	}
+}
+
+func TestHandlePassthroughToken(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authentication.PassthroughToken = true
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), &recordingAuthorizer{}, cfg)
+
+	// A request authenticated while presenting only a bearer token keeps it.
+	req := bearerRequest("user-token")
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Fatal("expected the request to be admitted")
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer user-token" {
+		t.Errorf("expected the bearer token to pass through, got %q", got)
+	}
+
+	// Without a bearer token there is nothing attributable to forward.
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Fatal("expected the request to be admitted")
+	}
+	if got := req.Header.Get("Authorization"); got != "" {
+		t.Errorf("expected a non-bearer credential to be stripped, got %q", got)
+	}
+
+	// A client certificate alongside the token means the authentication may
+	// not be attributable to the token: strip.
+	req = bearerRequest("user-token")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Fatal("expected the request to be admitted")
+	}
+	if got := req.Header.Get("Authorization"); got != "" {
+		t.Errorf("expected the token to be stripped next to a client certificate, got %q", got)
+	}
+
+	// The production bearer-token authenticator deletes the header on
+	// success; passthrough must restore the captured credential.
+	h = newKubeRBACProxyAuth(&headerConsumingAuthenticator{delegate: authenticateAs("jane")}, &recordingAuthorizer{}, cfg)
+	req = bearerRequest("user-token")
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Fatal("expected the request to be admitted")
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer user-token" {
+		t.Errorf("expected the consumed bearer token to be restored for the upstream, got %q", got)
+	}
+}
+
+func TestHandlePassthroughTokenDisabledKeepsHeader(t *testing.T) {
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), &recordingAuthorizer{}, testConfig())
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Fatal("expected the request to be admitted")
+	}
+	if got := req.Header.Get("Authorization"); got != "Basic dXNlcjpwYXNz" {
+		t.Errorf("expected the header to pass through untouched, got %q", got)
+	}
+}
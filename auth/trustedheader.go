@@ -0,0 +1,180 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/request/headerrequest"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// TrustedHeaderConfig configures authentication from identity headers set by
+// a trusted front proxy that has already authenticated the client.
+type TrustedHeaderConfig struct {
+	// The name of the header carrying the pre-authenticated user name
+	UserHeader string
+	// The name of the header carrying the pre-authenticated group memberships
+	GroupsHeader string
+	// Headers with this prefix are copied into the user's extra fields
+	ExtraHeaderPrefix string
+	// Only peers whose address falls into one of these CIDRs are trusted to
+	// set the identity headers. At least one of TrustedCIDRs and
+	// AllowedClientCNs must be set when trusted-header authentication is
+	// enabled; when both are set, a peer must satisfy both.
+	TrustedCIDRs []string
+	// AllowedClientCNs lists client certificate CommonNames trusted to set
+	// the identity headers. When non-empty, the peer must present a client
+	// certificate chaining to ClientCAFile with one of these CNs — a
+	// mutually-authenticated front proxy — before its headers are honored.
+	AllowedClientCNs []string
+	// ClientCAFile is the CA bundle the front proxy's client certificate
+	// must chain to. Required together with AllowedClientCNs.
+	ClientCAFile string
+}
+
+// trustedHeaderAuthenticator authenticates requests from identity headers,
+// but only for peers that prove to be the trusted front proxy — by source
+// CIDR, by a client certificate with an allowed CN, or both. Requests from
+// other peers are passed on to the next authenticator.
+type trustedHeaderAuthenticator struct {
+	headers    authenticator.Request
+	cidrs      []*net.IPNet
+	allowedCNs map[string]struct{}
+	caPool     *reloadableCertPool
+}
+
+func newTrustedHeaderAuthenticator(config *TrustedHeaderConfig, reloader *Reloader) (authenticator.Request, error) {
+	if len(config.TrustedCIDRs) == 0 && len(config.AllowedClientCNs) == 0 {
+		return nil, errors.New("trusted-header authentication requires at least one trusted CIDR or allowed client CN")
+	}
+
+	cidrs := make([]*net.IPNet, 0, len(config.TrustedCIDRs))
+	for _, c := range config.TrustedCIDRs {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse trusted CIDR %q: %v", c, err)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+
+	var (
+		allowedCNs map[string]struct{}
+		caPool     *reloadableCertPool
+	)
+	if len(config.AllowedClientCNs) > 0 {
+		if config.ClientCAFile == "" {
+			return nil, errors.New("trusted-header authentication with allowed client CNs requires a client CA file")
+		}
+		var err error
+		caPool, err = newReloadableCertPool(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		reloader.Register("trusted-header client CA bundle "+config.ClientCAFile, caPool.reload)
+		allowedCNs = make(map[string]struct{}, len(config.AllowedClientCNs))
+		for _, cn := range config.AllowedClientCNs {
+			allowedCNs[cn] = struct{}{}
+		}
+	}
+
+	groupHeaders := []string{}
+	if config.GroupsHeader != "" {
+		groupHeaders = append(groupHeaders, config.GroupsHeader)
+	}
+	extraPrefixes := []string{}
+	if config.ExtraHeaderPrefix != "" {
+		extraPrefixes = append(extraPrefixes, config.ExtraHeaderPrefix)
+	}
+
+	headers, err := headerrequest.New([]string{config.UserHeader}, groupHeaders, extraPrefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &trustedHeaderAuthenticator{
+		headers:    headers,
+		cidrs:      cidrs,
+		allowedCNs: allowedCNs,
+		caPool:     caPool,
+	}, nil
+}
+
+func (a *trustedHeaderAuthenticator) AuthenticateRequest(req *http.Request) (user.Info, bool, error) {
+	if len(a.cidrs) > 0 && !a.peerInTrustedCIDR(req) {
+		return nil, false, nil
+	}
+	if a.allowedCNs != nil && !a.peerHasAllowedCN(req) {
+		return nil, false, nil
+	}
+
+	return a.headers.AuthenticateRequest(req)
+}
+
+// peerInTrustedCIDR reports whether the connection's source address falls
+// into one of the trusted CIDRs.
+func (a *trustedHeaderAuthenticator) peerInTrustedCIDR(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, cidr := range a.cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerHasAllowedCN reports whether the peer presented a client certificate
+// that chains to the configured CA and carries one of the allowed
+// CommonNames. A missing, unverifiable, or differently-named certificate
+// leaves the peer untrusted.
+func (a *trustedHeaderAuthenticator) peerHasAllowedCN(req *http.Request) bool {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return false
+	}
+
+	leaf := req.TLS.PeerCertificates[0]
+	opts := x509.VerifyOptions{
+		Roots:     a.caPool.current(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if len(req.TLS.PeerCertificates) > 1 {
+		opts.Intermediates = x509.NewCertPool()
+		for _, intermediate := range req.TLS.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(intermediate)
+		}
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		return false
+	}
+
+	_, ok := a.allowedCNs[leaf.Subject.CommonName]
+	return ok
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrustedHeaderAuthenticatorHonorsTrustedCIDRs(t *testing.T) {
+	a, err := newTrustedHeaderAuthenticator(&TrustedHeaderConfig{
+		UserHeader:   "X-Auth-User",
+		GroupsHeader: "X-Auth-Groups",
+		TrustedCIDRs: []string{"10.0.0.0/8"},
+	}, NewReloader())
+	if err != nil {
+		t.Fatalf("unexpected constructor error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.RemoteAddr = "10.1.2.3:4711"
+	req.Header.Set("X-Auth-User", "jane")
+	req.Header.Set("X-Auth-Groups", "admins")
+
+	u, ok, err := a.AuthenticateRequest(req)
+	if err != nil || !ok {
+		t.Fatalf("expected the trusted peer's headers to authenticate, got ok=%v err=%v", ok, err)
+	}
+	if u.GetName() != "jane" {
+		t.Errorf("expected user %q, got %q", "jane", u.GetName())
+	}
+	groups := u.GetGroups()
+	if len(groups) != 1 || groups[0] != "admins" {
+		t.Errorf("expected groups [admins], got %v", groups)
+	}
+}
+
+func TestTrustedHeaderAuthenticatorIgnoresUntrustedPeers(t *testing.T) {
+	a, err := newTrustedHeaderAuthenticator(&TrustedHeaderConfig{
+		UserHeader:   "X-Auth-User",
+		TrustedCIDRs: []string{"10.0.0.0/8"},
+	}, NewReloader())
+	if err != nil {
+		t.Fatalf("unexpected constructor error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.RemoteAddr = "192.0.2.7:4711"
+	req.Header.Set("X-Auth-User", "jane")
+
+	_, ok, err := a.AuthenticateRequest(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ok {
+		t.Error("expected identity headers from an untrusted peer to be ignored")
+	}
+}
+
+func TestNewTrustedHeaderAuthenticatorRequiresTrustAnchor(t *testing.T) {
+	if _, err := newTrustedHeaderAuthenticator(&TrustedHeaderConfig{
+		UserHeader: "X-Auth-User",
+	}, NewReloader()); err == nil {
+		t.Error("expected a configuration without trusted CIDRs or allowed CNs to be rejected")
+	}
+}
+
+func TestHandleAuthenticatesTrustedHeaderPeers(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authentication.TrustedHeader = &TrustedHeaderConfig{
+		UserHeader:   "X-Auth-User",
+		TrustedCIDRs: []string{"127.0.0.0/8"},
+	}
+
+	h, err := BuildAuthHandler(allowAllKubeClient("unused"), cfg)
+	if err != nil {
+		t.Fatalf("unexpected handler error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.RemoteAddr = "127.0.0.1:4711"
+	req.Header.Set("X-Auth-User", "jane")
+
+	rec := httptest.NewRecorder()
+	if !h.Handle(rec, req) {
+		t.Fatalf("expected the request to be admitted, got status %d", rec.Code)
+	}
+	if u, ok := UserFrom(req.Context()); !ok || u.GetName() != "jane" {
+		t.Errorf("expected the trusted-header identity on the request context, got %v", u)
+	}
+}
+
+// issueClientCert generates a CA and a client certificate with the given CN
+// signed by it, returning the CA bundle PEM and the parsed client
+// certificate.
+func issueClientCert(t *testing.T, cn string) ([]byte, *x509.Certificate) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "front-proxy-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, caCert, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), leaf
+}
+
+func TestTrustedHeaderAuthenticatorHonorsAllowedClientCNs(t *testing.T) {
+	caPEM, leaf := issueClientCert(t, "front-proxy")
+	caFile := writeTempCA(t, caPEM)
+	defer os.RemoveAll(filepath.Dir(caFile))
+
+	a, err := newTrustedHeaderAuthenticator(&TrustedHeaderConfig{
+		UserHeader:       "X-Auth-User",
+		AllowedClientCNs: []string{"front-proxy"},
+		ClientCAFile:     caFile,
+	}, NewReloader())
+	if err != nil {
+		t.Fatalf("unexpected constructor error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("X-Auth-User", "jane")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+
+	u, ok, err := a.AuthenticateRequest(req)
+	if err != nil || !ok {
+		t.Fatalf("expected the mutually-authenticated front proxy to be trusted, got ok=%v err=%v", ok, err)
+	}
+	if u.GetName() != "jane" {
+		t.Errorf("expected user %q, got %q", "jane", u.GetName())
+	}
+}
+
+func TestTrustedHeaderAuthenticatorRejectsWrongCN(t *testing.T) {
+	caPEM, leaf := issueClientCert(t, "some-other-client")
+	caFile := writeTempCA(t, caPEM)
+	defer os.RemoveAll(filepath.Dir(caFile))
+
+	a, err := newTrustedHeaderAuthenticator(&TrustedHeaderConfig{
+		UserHeader:       "X-Auth-User",
+		AllowedClientCNs: []string{"front-proxy"},
+		ClientCAFile:     caFile,
+	}, NewReloader())
+	if err != nil {
+		t.Fatalf("unexpected constructor error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("X-Auth-User", "jane")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+	if _, ok, _ := a.AuthenticateRequest(req); ok {
+		t.Error("expected a certificate with an unlisted CN not to be trusted")
+	}
+
+	// A peer without any client certificate is not trusted either.
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("X-Auth-User", "jane")
+	if _, ok, _ := a.AuthenticateRequest(req); ok {
+		t.Error("expected a peer without a client certificate not to be trusted")
+	}
+}
+
+func TestTrustedHeaderAuthenticatorRejectsUnchainedCert(t *testing.T) {
+	caPEM, _ := issueClientCert(t, "front-proxy")
+	// The presented certificate has the right CN but chains to a different
+	// CA than the configured bundle.
+	_, strangerLeaf := issueClientCert(t, "front-proxy")
+	caFile := writeTempCA(t, caPEM)
+	defer os.RemoveAll(filepath.Dir(caFile))
+
+	a, err := newTrustedHeaderAuthenticator(&TrustedHeaderConfig{
+		UserHeader:       "X-Auth-User",
+		AllowedClientCNs: []string{"front-proxy"},
+		ClientCAFile:     caFile,
+	}, NewReloader())
+	if err != nil {
+		t.Fatalf("unexpected constructor error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("X-Auth-User", "jane")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{strangerLeaf}}
+	if _, ok, _ := a.AuthenticateRequest(req); ok {
+		t.Error("expected a certificate outside the configured CA not to be trusted")
+	}
+}
+
+func TestNewTrustedHeaderAuthenticatorRequiresCAWithCNs(t *testing.T) {
+	_, err := newTrustedHeaderAuthenticator(&TrustedHeaderConfig{
+		UserHeader:       "X-Auth-User",
+		AllowedClientCNs: []string{"front-proxy"},
+	}, NewReloader())
+	if err == nil {
+		t.Error("expected allowed client CNs without a CA file to be rejected")
+	}
+}
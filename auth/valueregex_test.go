@@ -0,0 +1,122 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompileValueRegexAnchorsThePattern(t *testing.T) {
+	re, err := compileValueRegex("[a-z0-9-]+")
+	if err != nil {
+		t.Fatalf("unexpected compile error: %v", err)
+	}
+	if !re.MatchString("tenant-a") {
+		t.Error("expected a fully matching value to be accepted")
+	}
+	// Only full matches count: a valid substring must not satisfy the
+	// pattern.
+	for _, value := range []string{"tenant a", "Tenant-A", "../tenant-a"} {
+		if re.MatchString(value) {
+			t.Errorf("expected %q to be rejected by the anchored pattern", value)
+		}
+	}
+
+	if _, err := compileValueRegex("(unclosed"); err == nil {
+		t.Error("expected an invalid pattern to fail compilation")
+	}
+}
+
+func TestHandleEnforcesQueryValueRegex(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization.ResourceAttributes = &ResourceAttributes{Namespace: "{{ .Value }}", Resource: "namespaces"}
+	cfg.Authorization.Rewrites = &SubjectAccessReviewRewrites{
+		ByQueryParameter: &QueryParameterRewriteConfig{Name: "namespace", ValueRegex: "[a-z0-9-]+"},
+	}
+	authz := &recordingAuthorizer{}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), authz, cfg)
+
+	if !h.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics?namespace=tenant-a", nil)) {
+		t.Error("expected a value matching the regex to be admitted")
+	}
+
+	rec := httptest.NewRecorder()
+	if h.Handle(rec, httptest.NewRequest(http.MethodGet, "/metrics?namespace=..%2Fetc", nil)) {
+		t.Error("expected a non-matching value to be rejected")
+	}
+	// The malformed value must never reach the authorizer.
+	for _, attrs := range authz.recorded() {
+		if attrs.GetNamespace() != "tenant-a" {
+			t.Errorf("unexpected attributes for a rejected value: %#v", attrs)
+		}
+	}
+}
+
+func TestHandleEnforcesHeaderValueRegex(t *testing.T) {
+	cfg := testConfig()
+	cfg.Authorization.ResourceAttributes = &ResourceAttributes{Namespace: "{{ .Value }}", Resource: "namespaces"}
+	cfg.Authorization.Rewrites = &SubjectAccessReviewRewrites{
+		ByHTTPHeader: &HTTPHeaderRewriteConfig{Name: "x-namespace", ValueRegex: "[a-z0-9-]+"},
+	}
+	h := newKubeRBACProxyAuth(authenticateAs("jane"), &recordingAuthorizer{}, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("x-namespace", "tenant-a")
+	if !h.Handle(httptest.NewRecorder(), req) {
+		t.Error("expected a header value matching the regex to be admitted")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("x-namespace", "tenant a")
+	if h.Handle(httptest.NewRecorder(), req) {
+		t.Error("expected a non-matching header value to be rejected")
+	}
+}
+
+func TestAuthzConfigValidateRejectsBadRewritePatterns(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  AuthzConfig
+	}{
+		{
+			name: "bad query valueRegex",
+			cfg: AuthzConfig{Rewrites: &SubjectAccessReviewRewrites{
+				ByQueryParameter: &QueryParameterRewriteConfig{Name: "namespace", ValueRegex: "(unclosed"},
+			}},
+		},
+		{
+			name: "bad header valueRegex",
+			cfg: AuthzConfig{Rewrites: &SubjectAccessReviewRewrites{
+				ByHTTPHeader: &HTTPHeaderRewriteConfig{Name: "x-namespace", ValueRegex: "(unclosed"},
+			}},
+		},
+		{
+			name: "bad path pattern",
+			cfg: AuthzConfig{Rewrites: &SubjectAccessReviewRewrites{
+				ByPathRegex: &PathRegexRewriteConfig{Pattern: "(unclosed"},
+			}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.cfg.Validate(); err == nil {
+				t.Error("expected validation to fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// validateClientCertUsage checks that a certificate presented as a client
+// credential actually declares itself to be one. Certificates lacking the
+// clientAuth extended key usage (e.g. a server certificate signed by the same
+// CA) are rejected even though they chain to a trusted root.
+func validateClientCertUsage(cert *x509.Certificate) error {
+	hasClientAuth := false
+	for _, eku := range cert.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageClientAuth || eku == x509.ExtKeyUsageAny {
+			hasClientAuth = true
+			break
+		}
+	}
+	if !hasClientAuth {
+		return fmt.Errorf("client certificate %q does not declare the clientAuth extended key usage", cert.Subject.CommonName)
+	}
+
+	// A certificate without a key usage extension is left to the CA's
+	// discretion; if one is present it must permit use for authentication.
+	if cert.KeyUsage != 0 && cert.KeyUsage&(x509.KeyUsageDigitalSignature|x509.KeyUsageKeyAgreement|x509.KeyUsageKeyEncipherment) == 0 {
+		return fmt.Errorf("client certificate %q has a key usage extension that does not permit client authentication", cert.Subject.CommonName)
+	}
+
+	return nil
+}
+
+// validateClientCertStrength enforces cryptographic policy on a presented
+// client certificate beyond chain validation: an RSA public key shorter than
+// the configured minimum and, when enabled, deprecated signature algorithms
+// (MD5, SHA-1) are rejected even though the certificate chains to a trusted
+// CA. Non-RSA keys (e.g. ECDSA) are not subject to the size check.
+func validateClientCertStrength(cert *x509.Certificate, cfg *X509Config) error {
+	if cfg.MinRSAKeySize > 0 {
+		if pub, ok := cert.PublicKey.(*rsa.PublicKey); ok && pub.N.BitLen() < cfg.MinRSAKeySize {
+			return fmt.Errorf("client certificate %q uses a %d-bit RSA key, below the required minimum of %d bits", cert.Subject.CommonName, pub.N.BitLen(), cfg.MinRSAKeySize)
+		}
+	}
+
+	if cfg.RejectWeakSignatureAlgorithms {
+		switch cert.SignatureAlgorithm {
+		case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+			return fmt.Errorf("client certificate %q is signed with deprecated algorithm %v", cert.Subject.CommonName, cert.SignatureAlgorithm)
+		}
+	}
+
+	return nil
+}
+
+// The client certificate fields that may be forwarded into the
+// SubjectAccessReview extra via X509Config.ExtraFields.
+const (
+	CertFieldSerial       = "serial"
+	CertFieldSANURI       = "san-uri"
+	CertFieldOrganization = "organization"
+)
+
+// withClientCertExtra returns a copy of the user with the configured client
+// certificate fields added to its extra, keyed as
+// "client-certificate/<field>". Multi-valued fields (SAN URIs, organizations)
+// map to multi-valued extra entries; this lets webhook authorizers decide
+// based on certificate metadata without re-parsing the certificate.
+func withClientCertExtra(u user.Info, cert *x509.Certificate, fields []string) user.Info {
+	extra := map[string][]string{}
+	for k, v := range u.GetExtra() {
+		extra[k] = v
+	}
+
+	for _, field := range fields {
+		key := "client-certificate/" + field
+		switch field {
+		case CertFieldSerial:
+			extra[key] = []string{cert.SerialNumber.String()}
+		case CertFieldSANURI:
+			values := make([]string, 0, len(cert.URIs))
+			for _, uri := range cert.URIs {
+				values = append(values, uri.String())
+			}
+			extra[key] = values
+		case CertFieldOrganization:
+			extra[key] = cert.Subject.Organization
+		}
+	}
+
+	return &user.DefaultInfo{
+		Name:   u.GetName(),
+		UID:    u.GetUID(),
+		Groups: u.GetGroups(),
+		Extra:  extra,
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/url"
+	"testing"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+func TestValidateClientCertUsage(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cert    *x509.Certificate
+		wantErr bool
+	}{
+		{
+			name: "client auth usage",
+			cert: &x509.Certificate{
+				Subject:     pkix.Name{CommonName: "client"},
+				ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			},
+		},
+		{
+			name: "any usage",
+			cert: &x509.Certificate{
+				Subject:     pkix.Name{CommonName: "client"},
+				ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			},
+		},
+		{
+			name: "server certificate",
+			cert: &x509.Certificate{
+				Subject:     pkix.Name{CommonName: "server"},
+				ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			},
+			wantErr: true,
+		},
+		{
+			name: "no extended key usage",
+			cert: &x509.Certificate{
+				Subject: pkix.Name{CommonName: "bare"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "key usage forbids authentication",
+			cert: &x509.Certificate{
+				Subject:     pkix.Name{CommonName: "cert-sign-only"},
+				ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+				KeyUsage:    x509.KeyUsageCertSign,
+			},
+			wantErr: true,
+		},
+		{
+			name: "digital signature key usage",
+			cert: &x509.Certificate{
+				Subject:     pkix.Name{CommonName: "client"},
+				ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+				KeyUsage:    x509.KeyUsageDigitalSignature,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateClientCertUsage(tc.cert)
+			if tc.wantErr && err == nil {
+				t.Error("expected the certificate to be rejected")
+			}
+			if !tc.wantErr && err != nil {
+				t.Errorf("expected the certificate to be accepted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestWithClientCertExtra(t *testing.T) {
+	serial := big.NewInt(4711)
+	sanURI, err := url.Parse("spiffe://cluster.local/ns/default/sa/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "client",
+			Organization: []string{"team-a", "team-b"},
+		},
+		URIs: []*url.URL{sanURI},
+	}
+	u := &user.DefaultInfo{
+		Name:  "client",
+		Extra: map[string][]string{"existing": {"kept"}},
+	}
+
+	got := withClientCertExtra(u, cert, []string{CertFieldSerial, CertFieldSANURI, CertFieldOrganization})
+	extra := got.GetExtra()
+	if v := extra["client-certificate/serial"]; len(v) != 1 || v[0] != "4711" {
+		t.Errorf("expected the serial extra, got %v", v)
+	}
+	if v := extra["client-certificate/san-uri"]; len(v) != 1 || v[0] != sanURI.String() {
+		t.Errorf("expected the SAN URI extra, got %v", v)
+	}
+	if v := extra["client-certificate/organization"]; len(v) != 2 {
+		t.Errorf("expected both organization values, got %v", v)
+	}
+	if v := extra["existing"]; len(v) != 1 || v[0] != "kept" {
+		t.Errorf("expected pre-existing extra values to be kept, got %v", v)
+	}
+
+	// Only the requested fields are added.
+	got = withClientCertExtra(u, cert, []string{CertFieldSerial})
+	if _, ok := got.GetExtra()["client-certificate/organization"]; ok {
+		t.Error("expected unrequested certificate fields to be omitted")
+	}
+}
+
+func TestValidateClientCertStrength(t *testing.T) {
+	weakRSA := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 1023), E: 65537}
+	strongRSA := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 2047), E: 65537}
+
+	for _, tc := range []struct {
+		name    string
+		cert    *x509.Certificate
+		cfg     *X509Config
+		wantErr bool
+	}{
+		{
+			name:    "RSA key below the minimum",
+			cert:    &x509.Certificate{PublicKey: weakRSA},
+			cfg:     &X509Config{MinRSAKeySize: 2048},
+			wantErr: true,
+		},
+		{
+			name: "RSA key at the minimum",
+			cert: &x509.Certificate{PublicKey: strongRSA},
+			cfg:  &X509Config{MinRSAKeySize: 2048},
+		},
+		{
+			name: "non-RSA key skips the size check",
+			cert: &x509.Certificate{PublicKey: struct{}{}},
+			cfg:  &X509Config{MinRSAKeySize: 4096},
+		},
+		{
+			name:    "SHA-1 signature rejected",
+			cert:    &x509.Certificate{SignatureAlgorithm: x509.SHA1WithRSA},
+			cfg:     &X509Config{RejectWeakSignatureAlgorithms: true},
+			wantErr: true,
+		},
+		{
+			name: "SHA-1 signature tolerated by default",
+			cert: &x509.Certificate{SignatureAlgorithm: x509.SHA1WithRSA},
+			cfg:  &X509Config{},
+		},
+		{
+			name: "SHA-256 signature accepted",
+			cert: &x509.Certificate{SignatureAlgorithm: x509.SHA256WithRSA},
+			cfg:  &X509Config{RejectWeakSignatureAlgorithms: true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateClientCertStrength(tc.cert, tc.cfg)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("validateClientCertStrength() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -17,17 +17,33 @@ limitations under the License.
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	stdflag "flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
@@ -40,16 +56,51 @@ import (
 	certutil "k8s.io/client-go/util/cert"
 
 	"github.com/brancz/kube-rbac-proxy/auth"
+	"github.com/brancz/kube-rbac-proxy/metrics"
 )
 
 type config struct {
-	insecureListenAddress  string
-	secureListenAddress    string
-	upstream               string
-	upstreamForceH2C       bool
-	resourceAttributesFile string
-	auth                   auth.AuthConfig
-	tls                    tlsConfig
+	insecureListenAddress     string
+	insecureAllowPaths        []string
+	secureListenAddress       string
+	metricsListenAddress      string
+	upstream                  string
+	upstreamForceH2C          bool
+	upstreamJSONErrors        bool
+	detectTruncatedResponses  bool
+	resourceAttributesFile    string
+	configFileName            string
+	requestTimeout            time.Duration
+	upstreamConnLifetime      time.Duration
+	upstreamCertFingerprint   string
+	upstreamFlushInterval     time.Duration
+	upstreamStreamingPaths    []string
+	maxStreamingConnections   int64
+	terminateOnTokenExpiry    bool
+	anonymousUpstream         string
+	anonymousUpstreamPaths    []string
+	bodyOnGetDelete           string
+	setForwardedHeaders       bool
+	rejectAmbiguousFraming    bool
+	http2MaxConcurrentStreams uint32
+	useSelfSAR                bool
+	proxyIdentity             string
+	authBackendQPS            float32
+	authBackendBurst          int
+	allowHTTPTrace            bool
+	verbOverrides             []string
+	cnGroups                  []string
+	responseLogLevels         []string
+	errorBodyMode             string
+	metricsLabelAllowlist     []string
+	allowedContentTypes       []string
+	upstreamHeaders           []string
+	preflightPolicy           string
+	corsAllowedOrigins        []string
+	corsAllowedMethods        []string
+	corsAllowedHeaders        []string
+	auth                      auth.AuthConfig
+	tls                       tlsConfig
 }
 
 type tlsConfig struct {
@@ -57,6 +108,437 @@ type tlsConfig struct {
 	keyFile      string
 	minVersion   string
 	cipherSuites []string
+	disableHTTP2 bool
+}
+
+type configfile struct {
+	AuthorizationConfig *auth.AuthzConfig `json:"authorization,omitempty"`
+}
+
+// mergeAuthzConfig overlays the authorization section of the config file over
+// the flag-provided configuration. Fields present in the file win; everything
+// else keeps its flag (or default) value.
+func mergeAuthzConfig(dst, src *auth.AuthzConfig) {
+	if src.Rewrites != nil {
+		dst.Rewrites = src.Rewrites
+	}
+	if src.ResourceAttributes != nil {
+		dst.ResourceAttributes = src.ResourceAttributes
+	}
+	if src.BaseResourceAttributes != nil {
+		dst.BaseResourceAttributes = src.BaseResourceAttributes
+	}
+	if src.NonResourceAttributes != nil {
+		dst.NonResourceAttributes = src.NonResourceAttributes
+	}
+	if len(src.AuthorizeVerbs) > 0 {
+		dst.AuthorizeVerbs = src.AuthorizeVerbs
+	}
+	if len(src.SkipAuthorizationForUserAgents) > 0 {
+		dst.SkipAuthorizationForUserAgents = src.SkipAuthorizationForUserAgents
+	}
+	if src.DefaultVerb != "" {
+		dst.DefaultVerb = src.DefaultVerb
+	}
+	if src.OptionsVerb != "" {
+		dst.OptionsVerb = src.OptionsVerb
+	}
+	if len(src.AllowedNamespaces) > 0 {
+		dst.AllowedNamespaces = src.AllowedNamespaces
+	}
+	if src.MaxReasonLength != 0 {
+		dst.MaxReasonLength = src.MaxReasonLength
+	}
+	if len(src.PathRules) > 0 {
+		dst.PathRules = src.PathRules
+	}
+	if src.RuleMatchStrategy != "" {
+		dst.RuleMatchStrategy = src.RuleMatchStrategy
+	}
+	if len(src.VerbOverrides) > 0 {
+		dst.VerbOverrides = src.VerbOverrides
+	}
+	if len(src.NonResourceVerbOverrides) > 0 {
+		dst.NonResourceVerbOverrides = src.NonResourceVerbOverrides
+	}
+	if src.IncludeSelectors {
+		dst.IncludeSelectors = src.IncludeSelectors
+	}
+	if src.TenantMetrics {
+		dst.TenantMetrics = src.TenantMetrics
+	}
+	if src.AllowCacheTTL != 0 {
+		dst.AllowCacheTTL = src.AllowCacheTTL
+	}
+	if src.DenyCacheTTL != 0 {
+		dst.DenyCacheTTL = src.DenyCacheTTL
+	}
+}
+
+const (
+	bodyPolicyAllow  = "allow"
+	bodyPolicyStrip  = "strip"
+	bodyPolicyReject = "reject"
+)
+
+const (
+	preflightPolicyRespond   = "respond"
+	preflightPolicyAuthorize = "authorize"
+)
+
+// isCORSPreflight reports whether the request is clearly a CORS preflight,
+// i.e. an OPTIONS request announcing its origin and intended method.
+func isCORSPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions &&
+		req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// answerCORSPreflight answers a preflight from an allowed origin with the
+// configured Access-Control-Allow-* headers and reports whether it did.
+// Preflights carry no credentials, so there is nothing to authorize; ones
+// from other origins are left to the caller.
+func answerCORSPreflight(w http.ResponseWriter, req *http.Request, cors *auth.CORSConfig) bool {
+	if cors == nil || !cors.OriginAllowed(req.Header.Get("Origin")) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", req.Header.Get("Origin"))
+	if len(cors.AllowedMethods) > 0 {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(cors.AllowedMethods, ", "))
+	}
+	if len(cors.AllowedHeaders) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+	}
+	w.Header().Add("Vary", "Origin")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// requestHasBody reports whether the request carries a body, either with an
+// explicit non-zero Content-Length or with chunked transfer encoding.
+func requestHasBody(req *http.Request) bool {
+	return req.ContentLength > 0 || (req.ContentLength == -1 && len(req.TransferEncoding) > 0)
+}
+
+// parseCertFingerprint parses a hex-encoded SHA-256 certificate fingerprint,
+// tolerating the colon separators and mixed case printed by openssl.
+func parseCertFingerprint(s string) ([]byte, error) {
+	fingerprint, err := hex.DecodeString(strings.Replace(strings.ToLower(s), ":", "", -1))
+	if err != nil {
+		return nil, err
+	}
+	if len(fingerprint) != sha256.Size {
+		return nil, fmt.Errorf("expected %d hex-encoded bytes, got %d", sha256.Size, len(fingerprint))
+	}
+	return fingerprint, nil
+}
+
+// pinVerifier returns a VerifyPeerCertificate callback rejecting any leaf
+// certificate whose SHA-256 fingerprint differs from the pinned one, even if
+// it chains to a trusted CA.
+func pinVerifier(fingerprint []byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("upstream presented no certificate")
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		if !bytes.Equal(sum[:], fingerprint) {
+			return fmt.Errorf("upstream certificate fingerprint %s does not match the pinned fingerprint", hex.EncodeToString(sum[:]))
+		}
+		return nil
+	}
+}
+
+// pathMatchesAny reports whether the request path matches one of the
+// configured path patterns, either exactly or as a prefix ending in '*'. The
+// path is cleaned first so traversal tricks cannot dodge a pattern.
+func pathMatchesAny(requestPath string, patterns []string) bool {
+	normalized := path.Clean("/" + requestPath)
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(normalized, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+			continue
+		}
+		if normalized == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// contentTypeAllowed reports whether the Content-Type's media type is in the
+// configured allowlist. Media type parameters (e.g. charset) are ignored for
+// the comparison; an unparseable Content-Type never matches.
+func contentTypeAllowed(contentType string, allowed []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		if strings.EqualFold(mediaType, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsJSON reports whether the Accept header asks for a JSON response.
+func acceptsJSON(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if mediaType == "application/json" || mediaType == "application/problem+json" {
+			return true
+		}
+	}
+	return false
+}
+
+// gatewayErrorHandler answers requests whose upstream round-trip failed. The
+// underlying error is logged but never sent to the client; a request that ran
+// into its context deadline maps to a 504, everything else to a 502. With
+// jsonErrors enabled, clients whose Accept header asks for JSON get a
+// structured error body instead of plain text, so API clients parse gateway
+// errors the same way as upstream ones.
+func gatewayErrorHandler(jsonErrors bool) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, req *http.Request, err error) {
+		status := http.StatusBadGateway
+		if req.Context().Err() == context.DeadlineExceeded {
+			status = http.StatusGatewayTimeout
+		}
+		glog.Errorf("Proxying request to %q failed: %v", req.URL.Path, err)
+
+		if jsonErrors && acceptsJSON(req.Header.Get("Accept")) {
+			body, marshalErr := json.Marshal(struct {
+				Error  string `json:"error"`
+				Status int    `json:"status"`
+			}{Error: http.StatusText(status), Status: status})
+			if marshalErr == nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(status)
+				w.Write(body)
+				return
+			}
+		}
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+// truncationDetectingBody wraps an upstream response body to distinguish a
+// connection failing mid-response from a clean end of body. A read error
+// other than EOF is logged and counted; returning it unchanged makes the
+// reverse proxy abort the client response, so the client observes a truncated
+// transfer instead of a seemingly complete one.
+type truncationDetectingBody struct {
+	io.ReadCloser
+	path string
+}
+
+func (b *truncationDetectingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		// Context errors mean the client went away or a request deadline
+		// fired — not the upstream failing mid-response.
+		metrics.RecordUpstreamTruncation()
+		glog.Errorf("Upstream connection failed mid-response for %q: %v", b.path, err)
+	}
+	return n, err
+}
+
+// isUpgradeRequest reports whether the request asks for a protocol upgrade
+// (e.g. a WebSocket handshake), i.e. will turn into a long-lived connection
+// when the upstream accepts it.
+func isUpgradeRequest(req *http.Request) bool {
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bindToTokenExpiry bounds a long-lived request by the expiry of the bearer
+// token it presented, read from the request context where the auth handler
+// stashed it before the authenticator consumed the Authorization header. A
+// token already past its expiry is answered with a 401 and false is
+// returned; an unexpired one yields a request whose context expires with the
+// token, tearing the proxied exchange down so the client reconnects with a
+// refreshed credential. Requests without a token expiry pass through
+// unchanged.
+func bindToTokenExpiry(w http.ResponseWriter, req *http.Request) (*http.Request, context.CancelFunc, bool) {
+	exp, ok := auth.TokenExpiryFrom(req.Context())
+	if !ok {
+		return req, func() {}, true
+	}
+	if !exp.After(time.Now()) {
+		// The authentication cache may still accept a token whose expiry has
+		// just passed; never start a long-lived connection on it.
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithDeadline(req.Context(), exp)
+	return req.WithContext(ctx), cancel, true
+}
+
+// ambiguousFraming reports whether the request presents conflicting body
+// framing: both Content-Length and Transfer-Encoding, or multiple differing
+// Content-Length values. Go's server normalizes most framing on its own, but
+// a proxy should never forward what remains ambiguous.
+func ambiguousFraming(req *http.Request) bool {
+	if len(req.TransferEncoding) > 0 && req.Header.Get("Content-Length") != "" {
+		return true
+	}
+	lengths := req.Header["Content-Length"]
+	if len(lengths) > 1 {
+		for _, l := range lengths[1:] {
+			if l != lengths[0] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func peerIsTrusted(remoteAddr string, cidrs []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwardedHeaders records the external request properties in the
+// X-Forwarded-Host, X-Forwarded-Proto and X-Forwarded-Port headers so that
+// upstreams building absolute URLs render correct external links. Values
+// already present are kept only when the peer is a trusted proxy; everything
+// else is overwritten from the connection the proxy itself observed.
+func setForwardedHeaders(req *http.Request, trustedPeer bool) {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+
+	if !trustedPeer || req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	if !trustedPeer || req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", scheme)
+	}
+	if !trustedPeer || req.Header.Get("X-Forwarded-Port") == "" {
+		port := ""
+		if _, p, err := net.SplitHostPort(req.Host); err == nil {
+			port = p
+		} else if scheme == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+		req.Header.Set("X-Forwarded-Port", port)
+	}
+}
+
+// configureHTTP2 applies the HTTP/2 listener policy to the secure server.
+// With disable set, only http/1.1 is advertised during ALPN, keeping clients
+// from negotiating h2 and removing HTTP/2-specific attack surface such as
+// rapid reset. Otherwise a positive maxStreams caps concurrent streams per
+// connection, bounding the work a single client can create through stream
+// churn; configuring the http2 server explicitly keeps net/http from
+// installing its own with defaults.
+func configureHTTP2(srv *http.Server, disable bool, maxStreams uint32) error {
+	if disable {
+		srv.TLSConfig.NextProtos = []string{"http/1.1"}
+		return nil
+	}
+	if maxStreams > 0 {
+		return http2.ConfigureServer(srv, &http2.Server{
+			MaxConcurrentStreams: maxStreams,
+		})
+	}
+	return nil
+}
+
+// lifetimeBoundedTransport returns a transport capping how long a pooled
+// upstream connection may live. The transport drops connections idling past
+// the lifetime by itself; the ticker additionally flushes the pool so that
+// even busy connection slots are re-dialed, picking up new endpoints behind a
+// VIP after a rollout.
+func lifetimeBoundedTransport(lifetime time.Duration) *http.Transport {
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		IdleConnTimeout: lifetime,
+	}
+	go func() {
+		for range time.Tick(lifetime) {
+			transport.CloseIdleConnections()
+		}
+	}()
+	return transport
+}
+
+// parseStaticHeaders parses the repeated --upstream-header 'Name=Value'
+// values into a header set.
+func parseStaticHeaders(pairs []string) (http.Header, error) {
+	headers := http.Header{}
+	for _, h := range pairs {
+		parts := strings.SplitN(h, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid header %q, expected 'Name=Value'", h)
+		}
+		headers.Add(parts[0], parts[1])
+	}
+	return headers, nil
+}
+
+// setStaticHeaders applies the static upstream headers to an outgoing header
+// set. Static headers are managed by the proxy alone; any client-supplied
+// copies are dropped so they cannot be spoofed.
+func setStaticHeaders(h http.Header, static http.Header) {
+	for name, values := range static {
+		h.Del(name)
+		for _, value := range values {
+			h.Add(name, value)
+		}
+	}
+}
+
+// rejectMissingHost answers requests without a Host with a 400, reporting
+// whether it wrote a response. HTTP/1.1 requires a Host header, and both
+// upstream forwarding and the X-Forwarded-* headers depend on it; rejecting
+// early keeps the attribute derivation from running on malformed requests.
+func rejectMissingHost(w http.ResponseWriter, req *http.Request) bool {
+	if req.Host != "" {
+		return false
+	}
+	http.Error(w, "Missing Host header", http.StatusBadRequest)
+	return true
+}
+
+// handleTrace rejects HTTP TRACE requests with a 405 unless they are
+// explicitly allowed, reporting whether it wrote a response. TRACE reflects
+// request content and enables cross-site tracing attacks, so forwarding it is
+// opt-in.
+func handleTrace(w http.ResponseWriter, req *http.Request, allow bool) bool {
+	if req.Method != http.MethodTrace || allow {
+		return false
+	}
+	http.Error(w, "TRACE requests are not allowed", http.StatusMethodNotAllowed)
+	return true
 }
 
 var versions = map[string]uint16{
@@ -76,8 +558,9 @@ func main() {
 	cfg := config{
 		auth: auth.AuthConfig{
 			Authentication: &auth.AuthnConfig{
-				X509:   &auth.X509Config{},
-				Header: &auth.AuthnHeaderConfig{},
+				X509:          &auth.X509Config{},
+				Header:        &auth.AuthnHeaderConfig{},
+				TrustedHeader: &auth.TrustedHeaderConfig{},
 			},
 			Authorization: &auth.AuthzConfig{},
 		},
@@ -89,25 +572,196 @@ func main() {
 
 	// kube-rbac-proxy flags
 	flagset.StringVar(&cfg.insecureListenAddress, "insecure-listen-address", "", "The address the kube-rbac-proxy HTTP server should listen on.")
+	flagset.StringSliceVar(&cfg.insecureAllowPaths, "insecure-allow-paths", nil, "Comma-separated list of non-resource URL paths (exact values or prefixes ending in '*') served without authentication on the insecure listener only, e.g. /metrics for a localhost scraper. The same paths keep requiring credentials on the secure listener.")
 	flagset.StringVar(&cfg.secureListenAddress, "secure-listen-address", "", "The address the kube-rbac-proxy HTTPs server should listen on.")
+	flagset.StringSliceVar(&cfg.responseLogLevels, "response-log-level", nil, "Comma-separated list of CLASS=level pairs (e.g. 2xx=5,4xx=2,5xx=0) mapping response status code classes to the glog verbosity their responses are logged at. Classes without a mapping are not logged. Empty disables response logging.")
+	flagset.BoolVar(&cfg.auth.Authorization.TenantMetrics, "metrics-per-tenant", false, "When set to true, authorization outcomes are additionally counted per tenant value captured by the configured rewrites. Use together with --metrics-label-allowlist to bound the tenant label's cardinality.")
+	flagset.StringSliceVar(&cfg.allowedContentTypes, "allowed-content-types", nil, "Comma-separated list of Content-Type media types accepted on mutating requests (POST, PUT, PATCH) carrying a body; others are rejected with a 415 after authorization. Empty accepts any content type.")
+	flagset.StringSliceVar(&cfg.metricsLabelAllowlist, "metrics-label-allowlist", nil, "Comma-separated list of values that may appear verbatim in metric labels carrying request-derived data (verbs, resources, namespaces, tenants); everything else is collapsed into an 'other' bucket, preventing metric cardinality explosion. Empty leaves values untouched.")
+	flagset.StringVar(&cfg.metricsListenAddress, "metrics-listen-address", "", "The address the kube-rbac-proxy should serve its own metrics on. Disabled if empty.")
 	flagset.StringVar(&cfg.upstream, "upstream", "", "The upstream URL to proxy to once requests have successfully been authenticated and authorized.")
 	flagset.BoolVar(&cfg.upstreamForceH2C, "upstream-force-h2c", false, "Force h2c to communiate with the upstream. This is required when the upstream speaks h2c(http/2 cleartext - insecure variant of http/2) only. For example, go-grpc server in the insecure mode, such as helm's tiller w/o TLS, speaks h2c only")
 	flagset.StringVar(&cfg.resourceAttributesFile, "resource-attributes-file", "", "File spec of attributes-record to use for SubjectAccessReview. If unspecified, requests will attempted to be verified through non-resource-url attributes in the SubjectAccessReview.")
+	flagset.DurationVar(&cfg.upstreamFlushInterval, "upstream-flush-interval", 10*time.Millisecond, "Flush interval used when proxying responses for paths listed in --upstream-streaming-paths, so large or infinite streams reach the client incrementally instead of being buffered.")
+	flagset.StringVar(&cfg.anonymousUpstream, "anonymous-upstream", "", "URL of an upstream serving public content. Requests to paths listed in --anonymous-upstream-paths that fail authorization are forwarded there instead of being answered with a 403.")
+	flagset.StringSliceVar(&cfg.anonymousUpstreamPaths, "anonymous-upstream-paths", nil, "Comma-separated list of paths (exact values or prefixes ending in '*') eligible for the anonymous upstream fallthrough. Paths outside the list keep returning 403 on failed authorization.")
+	flagset.BoolVar(&cfg.terminateOnTokenExpiry, "terminate-streams-on-token-expiry", false, "When set to true, upgraded and streaming-path connections authenticated by a JWT bearer token are terminated when the token's expiry passes, instead of serving indefinitely on credentials validated only at connection setup. Clients reconnect with a refreshed token.")
+	flagset.Int64Var(&cfg.maxStreamingConnections, "max-streaming-connections", 0, "Maximum number of concurrent upgraded (e.g. WebSocket) or streaming-path connections. Further such requests are rejected with a 503 until a connection closes, bounding the resources long-lived connections can hold. 0 disables the limit.")
+	flagset.StringSliceVar(&cfg.upstreamStreamingPaths, "upstream-streaming-paths", nil, "Comma-separated list of paths (exact values or prefixes ending in '*') whose responses are streamed to the client with --upstream-flush-interval instead of default buffering. Meant for endpoints serving large or infinite responses, e.g. log tailing.")
+	flagset.BoolVar(&cfg.detectTruncatedResponses, "detect-truncated-upstream-responses", false, "When set to true, an upstream connection failing mid-response is logged distinctly and counted in metrics, and the response to the client is aborted instead of ending as if it were complete.")
+	flagset.BoolVar(&cfg.upstreamJSONErrors, "upstream-json-errors", false, "When set to true, upstream connection failures are answered with a structured JSON error body for clients whose Accept header asks for JSON; other clients keep receiving the plain-text gateway error.")
+	flagset.StringVar(&cfg.upstreamCertFingerprint, "upstream-cert-sha256-fingerprint", "", "Hex-encoded SHA-256 fingerprint to pin the upstream server certificate to. Connections presenting a different certificate are rejected even when it chains to a trusted CA.")
+	flagset.DurationVar(&cfg.upstreamConnLifetime, "upstream-conn-max-lifetime", 0, "Maximum lifetime of a pooled connection to the upstream. Older idle connections are closed so that pooled connections do not pin to stale endpoints behind a VIP, e.g. across upstream rollouts. 0 keeps connections indefinitely.")
+	flagset.DurationVar(&cfg.requestTimeout, "overall-request-timeout", 0, "Overall time budget for a single request, covering authentication, authorization and the upstream round-trip. Requests exceeding the budget are answered with a 504. 0 disables the budget.")
+	flagset.StringVar(&cfg.bodyOnGetDelete, "body-on-get-delete", bodyPolicyAllow, "How to handle GET and DELETE requests carrying a body. One of 'allow' (forward as-is), 'strip' (drop the body before forwarding), 'reject' (answer with 400).")
+	flagset.StringVar(&cfg.configFileName, "config-file", "", "Configuration file to configure kube-rbac-proxy, e.g. SubjectAccessReview rewrites. Takes precedence over --resource-attributes-file.")
+	flagset.BoolVar(&cfg.rejectAmbiguousFraming, "reject-ambiguous-framing", true, "Reject requests whose body framing is ambiguous (both Content-Length and Transfer-Encoding, or conflicting Content-Length values) with a 400 instead of forwarding them, defending against request smuggling.")
+	flagset.StringVar(&cfg.preflightPolicy, "cors-preflight-policy", preflightPolicyRespond, "How to handle OPTIONS requests that are clearly CORS preflights. One of 'respond' (answer with 204 without forwarding) or 'authorize' (authorize them with the 'get' verb, or --authz-options-verb if set, and forward).")
+	flagset.StringSliceVar(&cfg.corsAllowedOrigins, "cors-allowed-origins", nil, "Comma-separated list of origins whose CORS preflights are answered directly by kube-rbac-proxy with the configured Access-Control-Allow-* headers, without an SAR; '*' allows any origin. Empty (the default) disables CORS handling.")
+	flagset.StringSliceVar(&cfg.corsAllowedMethods, "cors-allowed-methods", nil, "Comma-separated list of methods advertised in Access-Control-Allow-Methods on answered preflights. Only meaningful together with --cors-allowed-origins.")
+	flagset.StringSliceVar(&cfg.corsAllowedHeaders, "cors-allowed-headers", nil, "Comma-separated list of headers advertised in Access-Control-Allow-Headers on answered preflights. Only meaningful together with --cors-allowed-origins.")
+	flagset.StringArrayVar(&cfg.upstreamHeaders, "upstream-header", nil, "A static 'Name=Value' header to set on every request forwarded to the upstream, e.g. a backend API key the clients don't hold. May be repeated. Client-supplied values for these headers are always stripped.")
+	flagset.BoolVar(&cfg.allowHTTPTrace, "allow-http-trace", false, "When set to true, HTTP TRACE requests are authorized and forwarded like any other request. By default TRACE is rejected with a 405, as it reflects request content and enables cross-site tracing attacks.")
+	flagset.BoolVar(&cfg.setForwardedHeaders, "upstream-set-forwarded-headers", false, "When set to true, kube-rbac-proxy sets X-Forwarded-Host, X-Forwarded-Proto and X-Forwarded-Port on upstream requests based on the original request. Incoming values of these headers are only kept for peers matching --trusted-header-cidrs.")
 
 	// TLS flags
 	flagset.StringVar(&cfg.tls.certFile, "tls-cert-file", "", "File containing the default x509 Certificate for HTTPS. (CA cert, if any, concatenated after server cert)")
 	flagset.StringVar(&cfg.tls.keyFile, "tls-private-key-file", "", "File containing the default x509 private key matching --tls-cert-file.")
 	flagset.StringVar(&cfg.tls.minVersion, "tls-min-version", "VersionTLS12", "Minimum TLS version supported. Value must match version names from https://golang.org/pkg/crypto/tls/#pkg-constants.")
 	flagset.StringSliceVar(&cfg.tls.cipherSuites, "tls-cipher-suites", nil, "Comma-separated list of cipher suites for the server. Values are from tls package constants (https://golang.org/pkg/crypto/tls/#pkg-constants). If omitted, the default Go cipher suites will be used")
+	flagset.Uint32Var(&cfg.http2MaxConcurrentStreams, "http2-max-concurrent-streams", 0, "Maximum number of concurrent HTTP/2 streams per client connection on the secure listener, bounding the work a single client can create through stream churn (rapid reset). 0 uses the http2 package default.")
+	flagset.BoolVar(&cfg.tls.disableHTTP2, "tls-disable-http2", false, "When set to true, do not advertise HTTP/2 on the secure listener, forcing clients to HTTP/1.1. Removes HTTP/2-specific attack surface such as rapid reset.")
 
 	// Auth flags
 	flagset.StringVar(&cfg.auth.Authentication.X509.ClientCAFile, "client-ca-file", "", "If set, any request presenting a client certificate signed by one of the authorities in the client-ca-file is authenticated with an identity corresponding to the CommonName of the client certificate.")
+	flagset.DurationVar(&cfg.auth.Authentication.X509.ReloadInterval, "client-ca-reload-interval", 0, "How often the client-ca-file is checked for changes and reloaded, so client certificates signed by a rotated CA are accepted without a restart. 0 disables reloading; the bundle is then read once at startup.")
+	flagset.BoolVar(&cfg.auth.Authentication.X509.EnforceKeyUsage, "client-cert-enforce-key-usage", false, "When set to true, presented client certificates must declare the clientAuth extended key usage and a compatible key usage, rejecting e.g. server certificates used as client credentials.")
+	flagset.IntVar(&cfg.auth.Authentication.X509.MinRSAKeySize, "client-cert-min-rsa-key-size", 0, "Minimum RSA key size in bits for presented client certificates; certificates with shorter RSA keys are rejected even when signed by a trusted CA. 0 disables the check. Non-RSA keys are not affected.")
+	flagset.BoolVar(&cfg.auth.Authentication.X509.RejectWeakSignatureAlgorithms, "client-cert-reject-weak-signatures", false, "When set to true, client certificates signed with deprecated algorithms (MD5, SHA-1) are rejected even when signed by a trusted CA.")
+	flagset.StringSliceVar(&cfg.auth.Authentication.X509.ExtraFields, "client-cert-extra-fields", nil, "Comma-separated list of client certificate fields (serial, san-uri, organization) to copy into the SubjectAccessReview extra, so webhook authorizers can decide based on certificate metadata.")
+	flagset.BoolVar(&cfg.auth.Authentication.CapCacheAtTokenExpiry, "auth-cache-cap-token-expiry", false, "When set to true, cached authentication results are never served past the presenting token's own expiry; expired tokens are revalidated against the backend. Forced revalidations are counted in metrics.")
+	flagset.StringVar(&cfg.auth.Authentication.Challenge, "auth-challenge", "Bearer", "The WWW-Authenticate value sent with 401 responses, telling clients how to authenticate. May carry scheme parameters, e.g. 'Bearer realm=\"metrics\"'.")
+	flagset.BoolVar(&cfg.auth.Authentication.PassthroughToken, "auth-token-passthrough", false, "When set to true, the Authorization header is forwarded to the upstream only for requests that authenticated with a bearer token, so the upstream can make its own API calls on the user's behalf; requests presenting a client certificate have it stripped. When false, the header passes through untouched.")
+	flagset.StringSliceVar(&cfg.auth.Authentication.Audiences, "auth-token-audiences", nil, "Comma-separated list of audiences a bearer token must be scoped to in order to authenticate. Empty performs no audience check, keeping legacy (unscoped) service account tokens working.")
+	flagset.StringSliceVar(&cfg.auth.Authentication.StaticGroups, "auth-static-groups", nil, "Comma-separated list of groups appended to every authenticated user before authorization and header injection.")
+	flagset.StringSliceVar(&cfg.cnGroups, "auth-cn-group", nil, "Comma-separated list of CN=group pairs mapping an authenticated user name (e.g. a client certificate common name) to an additional group, applied before authorization and header injection.")
 	flagset.BoolVar(&cfg.auth.Authentication.Header.Enabled, "auth-header-fields-enabled", false, "When set to true, kube-rbac-proxy adds auth-related fields to the headers of http requests sent to the upstream")
 	flagset.StringVar(&cfg.auth.Authentication.Header.UserFieldName, "auth-header-user-field-name", "x-remote-user", "The name of the field inside a http(2) request header to tell the upstream server about the user's name")
 	flagset.StringVar(&cfg.auth.Authentication.Header.GroupsFieldName, "auth-header-groups-field-name", "x-remote-groups", "The name of the field inside a http(2) request header to tell the upstream server about the user's groups")
 	flagset.StringVar(&cfg.auth.Authentication.Header.GroupSeparator, "auth-header-groups-field-separator", "|", "The separator string used for concatenating multiple group names in a groups header field's value")
+	flagset.BoolVar(&cfg.auth.Authentication.Header.GroupsAsRepeatedHeader, "auth-header-groups-repeated", false, "When set to true, emit one groups header line per group instead of a single value joined by the separator, for upstreams that expect repeated header lines.")
+	flagset.StringVar(&cfg.auth.Authentication.Header.ExtraFieldPrefix, "auth-header-extra-field-prefix", "", "When set, every entry of the authenticated user's extra map is forwarded to the upstream as a header named <prefix><key>, with multiple values joined by the groups field separator. Extra keys are reduced to valid header name characters.")
+	flagset.StringVar(&cfg.auth.Authentication.Header.Encoding, "auth-header-encoding", auth.HeaderEncodingSanitize, "How identity values containing control characters are treated before being placed in upstream headers. One of sanitize (strip them), encode (percent-encode them) or reject (refuse the request).")
+	flagset.StringVar(&cfg.auth.Authentication.TrustedHeader.UserHeader, "trusted-header-user-field-name", "", "The name of a request header carrying a user name pre-authenticated by a trusted front proxy. Only honored for peers matching --trusted-header-cidrs.")
+	flagset.StringVar(&cfg.auth.Authentication.TrustedHeader.GroupsHeader, "trusted-header-groups-field-name", "", "The name of a request header carrying group memberships pre-authenticated by a trusted front proxy.")
+	flagset.StringVar(&cfg.auth.Authentication.TrustedHeader.ExtraHeaderPrefix, "trusted-header-extra-fields-prefix", "", "Request headers with this prefix are copied into the pre-authenticated user's extra fields.")
+	flagset.StringSliceVar(&cfg.auth.Authentication.TrustedHeader.TrustedCIDRs, "trusted-header-cidrs", nil, "Comma-separated list of CIDRs from which the trusted-header identity is accepted. At least one of --trusted-header-cidrs and --trusted-header-allowed-cns is required when trusted-header authentication is enabled; when both are set, a peer must satisfy both.")
+	flagset.StringSliceVar(&cfg.auth.Authentication.TrustedHeader.AllowedClientCNs, "trusted-header-allowed-cns", nil, "Comma-separated list of client certificate CommonNames trusted to set the identity headers. The front proxy must then present a client certificate chaining to --trusted-header-client-ca-file with one of these CNs.")
+	flagset.StringVar(&cfg.auth.Authentication.TrustedHeader.ClientCAFile, "trusted-header-client-ca-file", "", "CA bundle the front proxy's client certificate must chain to. Required together with --trusted-header-allowed-cns.")
+	flagset.StringSliceVar(&cfg.auth.Authentication.AnonymousPaths, "allow-anonymous-paths", nil, "Comma-separated list of paths (exact values or prefixes ending in '*') on which an identity resolving to the anonymous user is tolerated. Everywhere else anonymous identities are rejected regardless of the authenticator that produced them.")
+	flagset.StringSliceVar(&cfg.auth.Authentication.NoCachePaths, "auth-no-cache-paths", nil, "Comma-separated list of paths (exact values or prefixes ending in '*') for which authentication results are never served from the cache, revalidating credentials on every request.")
+	flagset.DurationVar(&cfg.auth.Authentication.CacheTTL, "auth-token-cache-ttl", 2*time.Minute, "How long successful token authentication results are cached, trading load on the API server's TokenReview endpoint against revocation delay.")
+	flagset.DurationVar(&cfg.auth.Authentication.FailureCacheTTL, "auth-failure-cache-ttl", 0, "How long an authentication failure for a given token is cached, short-circuiting repeated validation of known-bad credentials. 0 disables the negative cache.")
+
+	// Authz flags
+	flagset.StringSliceVar(&cfg.auth.Authorization.SkipAuthorizationForUserAgents, "authz-skip-user-agents", nil, "Comma-separated list of exact User-Agent values for which authorization is skipped after successful authentication. Meant for known internal agents; skipped authorizations are logged.")
+	flagset.StringVar(&cfg.auth.Authorization.OptionsVerb, "authz-options-verb", "", "The authorization verb to use for OPTIONS requests. When empty, OPTIONS requests fall back to --authz-default-verb.")
+	flagset.StringSliceVar(&cfg.verbOverrides, "authz-verb-override", nil, "Comma-separated list of METHOD=verb pairs merged over the built-in HTTP-method-to-verb mapping, e.g. PATCH=update. Can both change existing entries and map methods the built-in table leaves unmapped.")
+	flagset.StringVar(&cfg.auth.Authorization.DefaultVerb, "authz-default-verb", "", "The authorization verb to use for HTTP methods that do not map to a known verb. When empty, such requests are rejected with a 405.")
+	flagset.StringSliceVar(&cfg.auth.Authorization.AllowedNamespaces, "authz-allowed-namespaces", nil, "Comma-separated list of namespaces that SubjectAccessReview rewrites may derive from request data. Derived namespaces outside the list are rejected with a 403. Empty disables the restriction.")
+	flagset.StringVar(&cfg.auth.Authorization.RuleMatchStrategy, "authz-rule-match-strategy", auth.RuleMatchFirst, "Behavior when several per-path authorization rules match the same request. One of first-match (use the first matching rule in configuration order), most-specific (use the rule with the longest path pattern) or all-must-pass (require every matching rule to allow).")
+	flagset.BoolVar(&cfg.auth.Authorization.IncludeSelectors, "authz-include-selectors", false, "When set to true, copy the request's fieldSelector and labelSelector query parameters into the SubjectAccessReview extra, so selector-aware authorizers can restrict by them.")
+	flagset.StringSliceVar(&cfg.auth.Authorization.AuthorizeVerbs, "authorize-verbs", nil, "Comma-separated list of verbs that require a SubjectAccessReview; requests mapping to any other verb (e.g. get,head for a read-only sidecar) are allowed after successful authentication alone. Empty authorizes every verb.")
+	flagset.DurationVar(&cfg.auth.Authorization.AllowCacheTTL, "authz-allow-cache-ttl", 0, "How long allow decisions from the webhook authorizer are cached. 0 applies the default of 5 minutes.")
+	flagset.DurationVar(&cfg.auth.Authorization.DenyCacheTTL, "authz-deny-cache-ttl", 0, "How long deny decisions from the webhook authorizer are cached; keeping it short makes newly granted access visible quickly. 0 applies the default of 30 seconds.")
+	flagset.IntVar(&cfg.auth.Authorization.MaxReasonLength, "authz-max-reason-length", 0, "Maximum length of an authorizer reason captured when logging decisions; larger reasons are truncated. 0 applies the default of 1024.")
+	flagset.Float32Var(&cfg.authBackendQPS, "auth-backend-qps", 0, "Maximum sustained rate of requests reaching the authentication/authorization backends, shared across all clients. Excess requests are shed with a 429 and a Retry-After header. 0 disables the limit.")
+	flagset.IntVar(&cfg.authBackendBurst, "auth-backend-burst", 10, "Burst allowance on top of --auth-backend-qps.")
+	flagset.StringVar(&cfg.proxyIdentity, "proxy-identity", os.Getenv("POD_NAME"), "Identity of this proxy instance, annotated on every SubjectAccessReview in the extra field kube-rbac-proxy/identity so audit logs show which instance issued it. Defaults to the POD_NAME environment variable (downward API).")
+	flagset.DurationVar(&cfg.auth.Timeout, "auth-timeout", 0, "Maximum duration of a single authentication or authorization backend call; a hanging TokenReview or SubjectAccessReview endpoint fails the request instead of blocking it. 0 applies the default of 10 seconds, negative disables the bound.")
+	flagset.StringSliceVar(&cfg.auth.AllowedMethods, "allowed-methods", nil, "Comma-separated list of HTTP methods the proxy accepts at all, e.g. GET,HEAD for a read-only sidecar. Requests with any other method are rejected with a 405 and an Allow header before any authentication or authorization. Empty accepts every method.")
+	flagset.StringSliceVar(&cfg.auth.IgnorePaths, "ignore-paths", nil, "Comma-separated list of paths (exact values or prefixes ending in '*') proxied through without authentication or authorization, e.g. an upstream's /healthz. The request path is normalized before matching.")
+	flagset.StringVar(&cfg.errorBodyMode, "error-body-mode", "", "Format of the 401/403/500 response bodies: 'text' (generic status text) or 'json' (a structured error object). Empty keeps the plain-text default. In either mode the denied user, verb and resource stay in the logs and are not sent to the client.")
+	flagset.BoolVar(&cfg.auth.ServerTiming, "server-timing", false, "When set to true, responses carry a Server-Timing header with the authentication and authorization durations of the request. Off by default since it exposes internal timing to clients.")
+	flagset.BoolVar(&cfg.useSelfSAR, "authz-use-self-subject-access-review", false, "When set to true, authorize by issuing a SelfSubjectAccessReview with the caller's own bearer token instead of a SubjectAccessReview under the proxy's identity. The proxy then does not need permission to create SubjectAccessReviews, but only token-based clients can be authorized.")
 	flagset.Parse(os.Args[1:])
 
+	switch cfg.bodyOnGetDelete {
+	case bodyPolicyAllow, bodyPolicyStrip, bodyPolicyReject:
+	default:
+		glog.Fatalf("Invalid value %q for --body-on-get-delete", cfg.bodyOnGetDelete)
+	}
+
+	for _, pair := range cfg.verbOverrides {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			glog.Fatalf("Invalid value %q for --authz-verb-override, expected METHOD=verb", pair)
+		}
+		if cfg.auth.Authorization.VerbOverrides == nil {
+			cfg.auth.Authorization.VerbOverrides = map[string]string{}
+		}
+		cfg.auth.Authorization.VerbOverrides[strings.ToUpper(parts[0])] = parts[1]
+	}
+
+	responseLogLevels := map[string]glog.Level{}
+	for _, pair := range cfg.responseLogLevels {
+		parts := strings.SplitN(pair, "=", 2)
+		level, err := strconv.Atoi(parts[len(parts)-1])
+		if len(parts) != 2 || err != nil || level < 0 {
+			glog.Fatalf("Invalid value %q for --response-log-level, expected CLASS=level", pair)
+		}
+		switch parts[0] {
+		case "1xx", "2xx", "3xx", "4xx", "5xx":
+		default:
+			glog.Fatalf("Invalid status class %q for --response-log-level, expected one of 1xx to 5xx", parts[0])
+		}
+		responseLogLevels[parts[0]] = glog.Level(level)
+	}
+
+	for _, pair := range cfg.cnGroups {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			glog.Fatalf("Invalid value %q for --auth-cn-group, expected CN=group", pair)
+		}
+		if cfg.auth.Authentication.CNGroups == nil {
+			cfg.auth.Authentication.CNGroups = map[string]string{}
+		}
+		cfg.auth.Authentication.CNGroups[parts[0]] = parts[1]
+	}
+
+	for _, field := range cfg.auth.Authentication.X509.ExtraFields {
+		switch field {
+		case auth.CertFieldSerial, auth.CertFieldSANURI, auth.CertFieldOrganization:
+		default:
+			glog.Fatalf("Invalid value %q for --client-cert-extra-fields", field)
+		}
+	}
+
+	switch cfg.auth.Authentication.Header.Encoding {
+	case auth.HeaderEncodingSanitize, auth.HeaderEncodingEncode, auth.HeaderEncodingReject:
+	default:
+		glog.Fatalf("Invalid value %q for --auth-header-encoding", cfg.auth.Authentication.Header.Encoding)
+	}
+
+	switch cfg.errorBodyMode {
+	case "":
+	case auth.ErrorBodyText, auth.ErrorBodyJSON:
+		cfg.auth.ErrorBodies = &auth.ErrorBodyConfig{Mode: cfg.errorBodyMode}
+	default:
+		glog.Fatalf("Invalid value %q for --error-body-mode", cfg.errorBodyMode)
+	}
+
+	switch cfg.preflightPolicy {
+	case preflightPolicyRespond:
+	case preflightPolicyAuthorize:
+		if cfg.auth.Authorization.OptionsVerb == "" {
+			cfg.auth.Authorization.OptionsVerb = "get"
+		}
+	default:
+		glog.Fatalf("Invalid value %q for --cors-preflight-policy", cfg.preflightPolicy)
+	}
+
+	if cfg.authBackendQPS > 0 {
+		cfg.auth.BackendRateLimit = &auth.BackendRateLimitConfig{
+			QPS:   cfg.authBackendQPS,
+			Burst: cfg.authBackendBurst,
+		}
+	}
+
+	if len(cfg.corsAllowedOrigins) > 0 {
+		cfg.auth.CORS = &auth.CORSConfig{
+			AllowedOrigins: cfg.corsAllowedOrigins,
+			AllowedMethods: cfg.corsAllowedMethods,
+			AllowedHeaders: cfg.corsAllowedHeaders,
+		}
+	} else if len(cfg.corsAllowedMethods) > 0 || len(cfg.corsAllowedHeaders) > 0 {
+		glog.Fatal("--cors-allowed-methods and --cors-allowed-headers require --cors-allowed-origins")
+	}
+
+	if len(cfg.insecureAllowPaths) > 0 && cfg.insecureListenAddress == "" {
+		glog.Fatal("--insecure-allow-paths requires --insecure-listen-address")
+	}
+
 	upstreamURL, err := url.Parse(cfg.upstream)
 	if err != nil {
 		glog.Fatalf("Failed to build parse upstream URL: %v", err)
@@ -135,24 +789,312 @@ func main() {
 		}
 	}
 
+	if cfg.configFileName != "" {
+		b, err := ioutil.ReadFile(cfg.configFileName)
+		if err != nil {
+			glog.Fatalf("Failed to read the config file: %v", err)
+		}
+
+		configfile := configfile{}
+		err = yaml.Unmarshal(b, &configfile)
+		if err != nil {
+			glog.Fatalf("Failed to parse config file content: %v", err)
+		}
+
+		if configfile.AuthorizationConfig != nil {
+			mergeAuthzConfig(cfg.auth.Authorization, configfile.AuthorizationConfig)
+		}
+	}
+
+	if len(cfg.metricsLabelAllowlist) > 0 {
+		metrics.SetLabelAllowlist(cfg.metricsLabelAllowlist)
+	}
+
+	// Flag deprecated configuration so operators can migrate before removal.
+	// Each use shows up both in the logs and as a metric.
+	if cfg.resourceAttributesFile != "" {
+		glog.Warning("--resource-attributes-file is deprecated, use --config-file instead")
+		metrics.RecordDeprecatedField("resource-attributes-file")
+	}
+	if cfg.auth.Authorization.ResourceAttributes != nil && len(cfg.auth.Authorization.PathRules) == 0 {
+		glog.Warning("the top-level resourceAttributes configuration is deprecated, use per-path rules (pathRules) instead")
+		metrics.RecordDeprecatedField("authorization.resourceAttributes")
+	}
+
+	switch cfg.auth.Authorization.RuleMatchStrategy {
+	case "", auth.RuleMatchFirst, auth.RuleMatchMostSpecific, auth.RuleMatchAllMustPass:
+	default:
+		glog.Fatalf("Invalid value %q for --authz-rule-match-strategy", cfg.auth.Authorization.RuleMatchStrategy)
+	}
+	if rewrites := cfg.auth.Authorization.Rewrites; rewrites != nil && rewrites.ByQueryParameter != nil {
+		switch rewrites.ByQueryParameter.Mode {
+		case "", auth.RewriteModeAll, auth.RewriteModeAny:
+		default:
+			glog.Fatalf("Invalid value %q for rewrites.byQueryParameter.mode", rewrites.ByQueryParameter.Mode)
+		}
+	}
+	var stripAuthorizationPaths []string
+	for i, rule := range cfg.auth.Authorization.PathRules {
+		if rule.Path == "" {
+			glog.Fatalf("Path rule %d has no path", i)
+		}
+		if rule.ResourceAttributes == nil && len(rule.RequiredScopes) == 0 && rule.AuthorizationHeaderPolicy == "" {
+			glog.Fatalf("Path rule %d (%q) has neither resource attributes, required scopes nor an authorization header policy", i, rule.Path)
+		}
+		if rule.UseLocalSAR && (rule.ResourceAttributes == nil || rule.ResourceAttributes.Namespace == "") {
+			glog.Fatalf("Path rule %d (%q) asks for a local SubjectAccessReview but has no namespace in its resource attributes", i, rule.Path)
+		}
+		switch rule.AuthorizationHeaderPolicy {
+		case "", auth.AuthorizationHeaderPass:
+		case auth.AuthorizationHeaderStrip:
+			stripAuthorizationPaths = append(stripAuthorizationPaths, rule.Path)
+		default:
+			glog.Fatalf("Path rule %d (%q) has invalid authorization header policy %q", i, rule.Path, rule.AuthorizationHeaderPolicy)
+		}
+	}
+
+	// The handler variable below shadows the auth package; keep a reference to
+	// the package function needed later in the request path.
+	stripIdentityHeaders := auth.StripIdentityHeaders
+
 	auth, err := auth.BuildAuthHandler(kubeClient, &cfg.auth)
 	if err != nil {
 		glog.Fatalf("Failed to create auth: %v", err)
 	}
 
+	if cfg.useSelfSAR {
+		auth.EnableSelfSubjectAccessReview(kcfg)
+	}
+
+	if cfg.proxyIdentity != "" {
+		auth.SetProxyIdentity(cfg.proxyIdentity)
+	}
+
+	staticHeaders, err := parseStaticHeaders(cfg.upstreamHeaders)
+	if err != nil {
+		glog.Fatalf("Failed to parse --upstream-header: %v", err)
+	}
+
+	var trustedProxyCIDRs []*net.IPNet
+	for _, c := range cfg.auth.Authentication.TrustedHeader.TrustedCIDRs {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil {
+			glog.Fatalf("Failed to parse trusted CIDR %q: %v", c, err)
+		}
+		trustedProxyCIDRs = append(trustedProxyCIDRs, cidr)
+	}
+
 	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		metrics.RecordUpstreamResponse(resp.StatusCode)
+		if cfg.detectTruncatedResponses && resp.Body != nil {
+			path := ""
+			if resp.Request != nil && resp.Request.URL != nil {
+				path = resp.Request.URL.Path
+			}
+			resp.Body = &truncationDetectingBody{ReadCloser: resp.Body, path: path}
+		}
+		return nil
+	}
+	proxy.ErrorHandler = gatewayErrorHandler(cfg.upstreamJSONErrors)
+
+	if cfg.upstreamConnLifetime > 0 {
+		proxy.Transport = lifetimeBoundedTransport(cfg.upstreamConnLifetime)
+	}
+
+	if cfg.upstreamCertFingerprint != "" {
+		fingerprint, err := parseCertFingerprint(cfg.upstreamCertFingerprint)
+		if err != nil {
+			glog.Fatalf("Failed to parse upstream certificate fingerprint: %v", err)
+		}
+		transport, ok := proxy.Transport.(*http.Transport)
+		if !ok {
+			transport = &http.Transport{Proxy: http.ProxyFromEnvironment}
+			proxy.Transport = transport
+		}
+		transport.TLSClientConfig = &tls.Config{
+			VerifyPeerCertificate: pinVerifier(fingerprint),
+		}
+	}
+
+	// Responses for the configured streaming paths are proxied by a dedicated
+	// instance flushing to the client periodically, so large or infinite
+	// responses (e.g. log tailing) never accumulate in memory.
+	streamingProxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+	streamingProxy.FlushInterval = cfg.upstreamFlushInterval
+	streamingProxy.ModifyResponse = proxy.ModifyResponse
+	streamingProxy.ErrorHandler = proxy.ErrorHandler
+	streamingProxy.Transport = proxy.Transport
+
+	var anonymousProxy *httputil.ReverseProxy
+	if cfg.anonymousUpstream != "" {
+		anonymousURL, err := url.Parse(cfg.anonymousUpstream)
+		if err != nil {
+			glog.Fatalf("Failed to parse anonymous upstream URL: %v", err)
+		}
+		anonymousProxy = httputil.NewSingleHostReverseProxy(anonymousURL)
+	}
+
+	// Tracks in-flight upgraded and streaming-path connections for
+	// --max-streaming-connections.
+	var streamingConnections int64
+
 	mux := http.NewServeMux()
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		ok := auth.Handle(w, req)
+		if cfg.rejectAmbiguousFraming && ambiguousFraming(req) {
+			// Requests with conflicting body framing are a classic request
+			// smuggling vector; never forward them upstream.
+			http.Error(w, "Ambiguous request framing", http.StatusBadRequest)
+			return
+		}
+
+		if rejectMissingHost(w, req) {
+			return
+		}
+
+		if isCORSPreflight(req) {
+			if answerCORSPreflight(w, req, cfg.auth.CORS) {
+				return
+			}
+			if cfg.preflightPolicy == preflightPolicyRespond {
+				// Without CORS configuration a preflight would map to an odd
+				// verb and surprise browser clients; answer it directly
+				// instead of forwarding.
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		if handleTrace(w, req, cfg.allowHTTPTrace) {
+			return
+		}
+
+		if (req.Method == http.MethodGet || req.Method == http.MethodDelete) && requestHasBody(req) {
+			// Bodies on GET/DELETE interact oddly with verb-derived
+			// authorization and with forwarding, so their handling is
+			// explicitly configurable.
+			switch cfg.bodyOnGetDelete {
+			case bodyPolicyReject:
+				http.Error(w, fmt.Sprintf("%s requests with a body are not allowed", req.Method), http.StatusBadRequest)
+				return
+			case bodyPolicyStrip:
+				req.Body.Close()
+				req.Body = http.NoBody
+				req.ContentLength = 0
+				req.TransferEncoding = nil
+				req.Header.Del("Content-Length")
+			}
+		}
+
+		authWriter := w
+		var interceptor *forbiddenInterceptor
+		if anonymousProxy != nil && pathMatchesAny(req.URL.Path, cfg.anonymousUpstreamPaths) {
+			interceptor = &forbiddenInterceptor{w: w}
+			authWriter = interceptor
+		}
+
+		ok := auth.Handle(authWriter, req)
 		if !ok {
+			if interceptor != nil && interceptor.intercepted {
+				// The request failed authorization on a path explicitly
+				// configured for the anonymous fallthrough; serve the public
+				// subset instead of the 403. Credentials are stripped so the
+				// anonymous upstream can never act on them.
+				req.Header.Del("Authorization")
+				anonymousProxy.ServeHTTP(w, req)
+			}
 			return
 		}
 
+		if pathMatchesAny(req.URL.Path, stripAuthorizationPaths) {
+			// The upstream behind these paths relies on the injected identity
+			// headers alone; the client's credential must not reach it.
+			req.Header.Del("Authorization")
+		}
+
+		if len(cfg.allowedContentTypes) > 0 && requestHasBody(req) &&
+			(req.Method == http.MethodPost || req.Method == http.MethodPut || req.Method == http.MethodPatch) &&
+			!contentTypeAllowed(req.Header.Get("Content-Type"), cfg.allowedContentTypes) {
+			// Checked after authorization so that probing for accepted
+			// content types requires valid credentials.
+			http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if cfg.setForwardedHeaders {
+			setForwardedHeaders(req, peerIsTrusted(req.RemoteAddr, trustedProxyCIDRs))
+		}
+
+		setStaticHeaders(req.Header, staticHeaders)
+
+		isStreaming := pathMatchesAny(req.URL.Path, cfg.upstreamStreamingPaths)
+
+		if cfg.terminateOnTokenExpiry && (isStreaming || isUpgradeRequest(req)) {
+			bounded, cancel, ok := bindToTokenExpiry(w, req)
+			if !ok {
+				return
+			}
+			defer cancel()
+			req = bounded
+		}
+
+		if cfg.maxStreamingConnections > 0 && (isStreaming || isUpgradeRequest(req)) {
+			// Long-lived connections hold resources until they close; cap how
+			// many may be in flight at once. The slot is held for the whole
+			// proxied exchange, so the counter covers the connection lifetime.
+			if atomic.AddInt64(&streamingConnections, 1) > cfg.maxStreamingConnections {
+				atomic.AddInt64(&streamingConnections, -1)
+				glog.V(2).Infof("Rejecting request to %q: streaming connection limit of %d reached", req.URL.Path, cfg.maxStreamingConnections)
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			defer atomic.AddInt64(&streamingConnections, -1)
+		}
+
+		if isStreaming {
+			streamingProxy.ServeHTTP(w, req)
+			return
+		}
 		proxy.ServeHTTP(w, req)
 	}))
 
+	var handler http.Handler = mux
+	if cfg.requestTimeout > 0 {
+		handler = &budgetHandler{handler: mux, budget: cfg.requestTimeout}
+	}
+	if len(responseLogLevels) > 0 {
+		// Outermost so that it sees the final status of every response,
+		// including budget timeouts.
+		handler = &responseLogHandler{handler: handler, levels: responseLogLevels}
+	}
+
 	if cfg.secureListenAddress != "" {
-		srv := &http.Server{Handler: mux}
+		srv := &http.Server{Handler: handler}
+
+		version, err := tlsVersion(cfg.tls.minVersion)
+		if err != nil {
+			glog.Fatalf("TLS version invalid: %v", err)
+		}
+
+		cipherSuiteIDs, err := k8sapiflag.TLSCipherSuites(cfg.tls.cipherSuites)
+		if err != nil {
+			glog.Fatalf("Failed to convert TLS cipher suite name to ID: %v", err)
+		}
+
+		srv.TLSConfig = &tls.Config{
+			CipherSuites: cipherSuiteIDs,
+			MinVersion:   version,
+			// Request (but don't require) a client certificate so that x509
+			// client authentication can inspect it.
+			ClientAuth: tls.RequestClientCert,
+			// To enable http/2
+			// See net/http.Server.shouldConfigureHTTP2ForServe for more context
+			NextProtos: []string{"h2"},
+		}
+
+		if err := configureHTTP2(srv, cfg.tls.disableHTTP2, cfg.http2MaxConcurrentStreams); err != nil {
+			glog.Fatalf("Failed to configure http2 server: %v", err)
+		}
 
 		if cfg.tls.certFile == "" && cfg.tls.keyFile == "" {
 			glog.Info("Generating self signed cert as no cert is provided")
@@ -165,23 +1107,7 @@ func main() {
 				glog.Fatalf("Failed to load generated self signed cert and key: %v", err)
 			}
 
-			version, err := tlsVersion(cfg.tls.minVersion)
-			if err != nil {
-				glog.Fatalf("TLS version invalid: %v", err)
-			}
-
-			cipherSuiteIDs, err := k8sapiflag.TLSCipherSuites(cfg.tls.cipherSuites)
-			if err != nil {
-				glog.Fatalf("Failed to convert TLS cipher suite name to ID: %v", err)
-			}
-			srv.TLSConfig = &tls.Config{
-				CipherSuites: cipherSuiteIDs,
-				Certificates: []tls.Certificate{cert},
-				MinVersion:   version,
-				// To enable http/2
-				// See net/http.Server.shouldConfigureHTTP2ForServe for more context
-				NextProtos: []string{"h2"},
-			}
+			srv.TLSConfig.Certificates = []tls.Certificate{cert}
 		}
 
 		l, err := net.Listen("tcp", cfg.secureListenAddress)
@@ -206,6 +1132,7 @@ func main() {
 					return net.Dial(netw, addr)
 				},
 			}
+			streamingProxy.Transport = proxy.Transport
 		}
 
 		// Background:
@@ -238,7 +1165,27 @@ func main() {
 		// - https://github.com/grpc/grpc-go/pull/1406/files
 		// - https://github.com/grpc/grpc-go/issues/549#issuecomment-191458335
 		// - https://github.com/golang/go/issues/14141#issuecomment-176465220
-		h2cHandler := &h2c.Server{Handler: mux}
+		insecureHandler := handler
+		if len(cfg.insecureAllowPaths) > 0 {
+			// The declared non-resource URLs are proxied through without
+			// authentication, but only on this listener: its listen address
+			// is expected to restrict who can reach it (e.g. localhost for a
+			// node-local scraper). The secure listener keeps requiring
+			// credentials for the same paths. Credentials and identity
+			// headers are stripped so the upstream cannot act on them.
+			authedHandler := handler
+			insecureHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if !pathMatchesAny(req.URL.Path, cfg.insecureAllowPaths) {
+					authedHandler.ServeHTTP(w, req)
+					return
+				}
+				req.Header.Del("Authorization")
+				stripIdentityHeaders(req.Header, cfg.auth.Authentication.Header)
+				proxy.ServeHTTP(w, req)
+			})
+		}
+
+		h2cHandler := &h2c.Server{Handler: insecureHandler}
 
 		srv := &http.Server{Handler: h2cHandler}
 
@@ -250,6 +1197,44 @@ func main() {
 		go srv.Serve(l)
 	}
 
+	if cfg.metricsListenAddress != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metrics.Handler())
+		metricsMux.Handle("/readyz", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// Readiness covers backend connectivity: a proxy without working
+			// TokenReview/SubjectAccessReview access would otherwise serve
+			// traffic and fail every request with confusing errors.
+			ctx, cancel := context.WithTimeout(req.Context(), 10*time.Second)
+			defer cancel()
+			if err := auth.Healthy(ctx); err != nil {
+				glog.V(2).Infof("Readiness check failed: %v", err)
+				http.Error(w, fmt.Sprintf("not ready: %v", err), http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		}))
+
+		l, err := net.Listen("tcp", cfg.metricsListenAddress)
+		if err != nil {
+			glog.Fatalf("Failed to listen on metrics address: %v", err)
+		}
+		glog.Infof("Serving metrics on %v", cfg.metricsListenAddress)
+		go (&http.Server{Handler: metricsMux}).Serve(l)
+	}
+
+	// SIGHUP reloads the handler's reloadable state (client CA bundles) on
+	// demand, independent of any configured periodic reload interval.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			glog.Info("Received SIGHUP, reloading...")
+			if err := auth.Reloader().Reload(); err != nil {
+				glog.Errorf("Reload failed: %v", err)
+			}
+		}
+	}()
+
 	term := make(chan os.Signal)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
 
@@ -258,3 +1243,257 @@ func main() {
 		glog.Info("Received SIGTERM, exiting gracefully...")
 	}
 }
+
+// forbiddenInterceptor wraps a ResponseWriter and swallows a 403 response, so
+// that the caller can serve the request differently (e.g. from the anonymous
+// upstream) instead. Any other status passes through untouched.
+type forbiddenInterceptor struct {
+	w           http.ResponseWriter
+	header      http.Header
+	intercepted bool
+	wroteHeader bool
+}
+
+func (i *forbiddenInterceptor) Header() http.Header {
+	if i.header == nil {
+		i.header = http.Header{}
+	}
+	return i.header
+}
+
+func (i *forbiddenInterceptor) WriteHeader(code int) {
+	if i.wroteHeader {
+		return
+	}
+	i.wroteHeader = true
+	if code == http.StatusForbidden {
+		i.intercepted = true
+		return
+	}
+	for name, values := range i.header {
+		i.w.Header()[name] = values
+	}
+	i.w.WriteHeader(code)
+}
+
+func (i *forbiddenInterceptor) Write(p []byte) (int, error) {
+	if !i.wroteHeader {
+		i.WriteHeader(http.StatusOK)
+	}
+	if i.intercepted {
+		return len(p), nil
+	}
+	return i.w.Write(p)
+}
+
+func (i *forbiddenInterceptor) Unwrap() http.ResponseWriter { return i.w }
+
+// Hijack hands the connection over for protocol upgrades. A hijacked
+// connection cannot be intercepted anymore; the upstream owns it from here.
+func (i *forbiddenInterceptor) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := i.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		i.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+// budgetHandler enforces an overall per-request time budget covering
+// authentication, authorization and the upstream round-trip. It is distinct
+// from any timeouts the individual components may apply; a combination of a
+// slow SubjectAccessReview and a slow upstream cannot exceed the budget. A
+// request that exceeds the budget is answered with a 504 if no response has
+// been started yet, otherwise the response is cut off.
+type budgetHandler struct {
+	handler http.Handler
+	budget  time.Duration
+}
+
+func (h *budgetHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), h.budget)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	bw := &budgetWriter{w: w, h: make(http.Header)}
+	done := make(chan struct{})
+	panicChan := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				panicChan <- p
+			}
+		}()
+		h.handler.ServeHTTP(bw, req)
+		close(done)
+	}()
+
+	select {
+	case p := <-panicChan:
+		panic(p)
+	case <-done:
+	case <-ctx.Done():
+		bw.timeout()
+	}
+}
+
+// budgetWriter passes writes through to the underlying ResponseWriter without
+// buffering the body, but keeps a private header map until the header is
+// written so that a concurrent timeout cannot race with the inner handler.
+type budgetWriter struct {
+	mu          sync.Mutex
+	w           http.ResponseWriter
+	h           http.Header
+	timedOut    bool
+	wroteHeader bool
+}
+
+func (bw *budgetWriter) Header() http.Header { return bw.h }
+
+func (bw *budgetWriter) WriteHeader(code int) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	bw.writeHeader(code)
+}
+
+func (bw *budgetWriter) writeHeader(code int) {
+	if bw.timedOut || bw.wroteHeader {
+		return
+	}
+	dst := bw.w.Header()
+	for k, v := range bw.h {
+		dst[k] = v
+	}
+	bw.w.WriteHeader(code)
+	bw.wroteHeader = true
+}
+
+func (bw *budgetWriter) Write(b []byte) (int, error) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	if bw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !bw.wroteHeader {
+		bw.writeHeader(http.StatusOK)
+	}
+	return bw.w.Write(b)
+}
+
+func (bw *budgetWriter) Flush() {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	if f, ok := bw.w.(http.Flusher); ok && bw.wroteHeader {
+		f.Flush()
+	}
+}
+
+func (bw *budgetWriter) Unwrap() http.ResponseWriter { return bw.w }
+
+// Hijack hands the connection over for protocol upgrades (e.g. WebSockets).
+// The budget stops applying once the connection is hijacked: the writer is
+// marked as written so a later timeout cannot push a 504 onto a connection
+// that now speaks a different protocol.
+func (bw *budgetWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	if bw.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	hj, ok := bw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		bw.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+// timeout marks the writer as timed out and, if nothing has been sent yet,
+// answers the request with a 504.
+func (bw *budgetWriter) timeout() {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	if !bw.wroteHeader {
+		http.Error(bw.w, "request exceeded the configured time budget", http.StatusGatewayTimeout)
+	}
+	bw.timedOut = true
+}
+
+// responseLogHandler logs a line per response at a verbosity chosen by the
+// response's status code class, so operators can e.g. log 5xx unconditionally
+// while 2xx only shows up under high verbosity. Classes without a configured
+// level are not logged at all.
+type responseLogHandler struct {
+	handler http.Handler
+	levels  map[string]glog.Level
+}
+
+func (h *responseLogHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	lw := &statusRecordingWriter{w: w}
+	h.handler.ServeHTTP(lw, req)
+
+	status := lw.status
+	if status == 0 {
+		// Nothing was written; net/http sends a 200 for a handler that
+		// returns without writing.
+		status = http.StatusOK
+	}
+	class := "1xx"
+	if status >= 200 && status < 600 {
+		class = strconv.Itoa(status/100) + "xx"
+	}
+	if level, ok := h.levels[class]; ok {
+		glog.V(level).Infof("%s %s from %s: %d", req.Method, req.URL.Path, req.RemoteAddr, status)
+	}
+}
+
+// statusRecordingWriter remembers the status code of the response passing
+// through it.
+type statusRecordingWriter struct {
+	w      http.ResponseWriter
+	status int
+}
+
+func (lw *statusRecordingWriter) Header() http.Header { return lw.w.Header() }
+
+func (lw *statusRecordingWriter) WriteHeader(code int) {
+	if lw.status == 0 {
+		lw.status = code
+	}
+	lw.w.WriteHeader(code)
+}
+
+func (lw *statusRecordingWriter) Write(b []byte) (int, error) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	return lw.w.Write(b)
+}
+
+func (lw *statusRecordingWriter) Flush() {
+	if f, ok := lw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (lw *statusRecordingWriter) Unwrap() http.ResponseWriter { return lw.w }
+
+// Hijack hands the connection over for protocol upgrades, recording the 101
+// that a successful upgrade implies.
+func (lw *statusRecordingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := lw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil && lw.status == 0 {
+		lw.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
@@ -0,0 +1,781 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/brancz/kube-rbac-proxy/auth"
+	"github.com/brancz/kube-rbac-proxy/metrics"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBudgetHandlerPassesFastRequestsThrough(t *testing.T) {
+	h := &budgetHandler{
+		handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("X-Test", "yes")
+			w.WriteHeader(http.StatusTeapot)
+			w.Write([]byte("done"))
+		}),
+		budget: time.Second,
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fast", nil))
+
+	if rec.Code != http.StatusTeapot {
+		t.Errorf("expected status %d, got %d", http.StatusTeapot, rec.Code)
+	}
+	if rec.Header().Get("X-Test") != "yes" {
+		t.Error("expected the inner handler's header to pass through")
+	}
+	if rec.Body.String() != "done" {
+		t.Errorf("expected body %q, got %q", "done", rec.Body.String())
+	}
+}
+
+func TestBudgetHandlerAnswers504WhenBudgetExceeded(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	h := &budgetHandler{
+		handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			<-release
+		}),
+		budget: 10 * time.Millisecond,
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slow", nil))
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected status %d, got %d", http.StatusGatewayTimeout, rec.Code)
+	}
+}
+
+func TestBudgetHandlerDoesNotOverwriteStartedResponses(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	h := &budgetHandler{
+		handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			close(started)
+			<-release
+		}),
+		budget: 10 * time.Millisecond,
+	}
+
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/started", nil))
+		close(done)
+	}()
+	<-started
+	<-done
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected the started 200 response to stand, got %d", rec.Code)
+	}
+}
+
+func TestRequestHasBody(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		contentLength    int64
+		transferEncoding []string
+		want             bool
+	}{
+		{name: "no body", contentLength: 0, want: false},
+		{name: "content length", contentLength: 12, want: true},
+		{name: "chunked", contentLength: -1, transferEncoding: []string{"chunked"}, want: true},
+		{name: "unknown length without encoding", contentLength: -1, want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/resource", nil)
+			req.ContentLength = tc.contentLength
+			req.TransferEncoding = tc.transferEncoding
+			if got := requestHasBody(req); got != tc.want {
+				t.Errorf("requestHasBody = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBudgetWriterSupportsHijackForUpgrades(t *testing.T) {
+	h := &budgetHandler{
+		handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			hj, ok := w.(http.Hijacker)
+			if !ok {
+				t.Error("expected the budget writer to implement http.Hijacker")
+				return
+			}
+			conn, rw, err := hj.Hijack()
+			if err != nil {
+				t.Errorf("unexpected hijack error: %v", err)
+				return
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nhi")
+			rw.Flush()
+		}),
+		budget: time.Second,
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "hi" {
+		t.Errorf("expected a 200 %q response over the hijacked connection, got %d %q", "hi", resp.StatusCode, body)
+	}
+}
+
+func TestPeerIsTrusted(t *testing.T) {
+	_, cidr, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidrs := []*net.IPNet{cidr}
+
+	for _, tc := range []struct {
+		remoteAddr string
+		want       bool
+	}{
+		{"10.1.2.3:4711", true},
+		{"10.1.2.3", true},
+		{"192.0.2.7:4711", false},
+		{"not-an-ip", false},
+	} {
+		if got := peerIsTrusted(tc.remoteAddr, cidrs); got != tc.want {
+			t.Errorf("peerIsTrusted(%q) = %v, want %v", tc.remoteAddr, got, tc.want)
+		}
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com:8080/resource", nil)
+	req.Header.Set("X-Forwarded-Host", "spoofed")
+	setForwardedHeaders(req, false)
+
+	if got := req.Header.Get("X-Forwarded-Host"); got != "example.com:8080" {
+		t.Errorf("expected untrusted forwarded host to be overwritten, got %q", got)
+	}
+	if got := req.Header.Get("X-Forwarded-Proto"); got != "http" {
+		t.Errorf("expected proto %q, got %q", "http", got)
+	}
+	if got := req.Header.Get("X-Forwarded-Port"); got != "8080" {
+		t.Errorf("expected port %q, got %q", "8080", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/resource", nil)
+	req.Header.Set("X-Forwarded-Host", "public.example.com")
+	setForwardedHeaders(req, true)
+
+	if got := req.Header.Get("X-Forwarded-Host"); got != "public.example.com" {
+		t.Errorf("expected a trusted peer's forwarded host to be kept, got %q", got)
+	}
+	if got := req.Header.Get("X-Forwarded-Port"); got != "80" {
+		t.Errorf("expected default port %q, got %q", "80", got)
+	}
+}
+
+func TestHandleTrace(t *testing.T) {
+	req := httptest.NewRequest(http.MethodTrace, "/resource", nil)
+	rec := httptest.NewRecorder()
+	if !handleTrace(rec, req, false) {
+		t.Error("expected TRACE to be rejected by default")
+	}
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	if handleTrace(rec, req, true) {
+		t.Error("expected TRACE to pass through when explicitly allowed")
+	}
+
+	rec = httptest.NewRecorder()
+	if handleTrace(rec, httptest.NewRequest(http.MethodGet, "/resource", nil), false) {
+		t.Error("expected non-TRACE methods to pass through")
+	}
+}
+
+func TestParseStaticHeaders(t *testing.T) {
+	headers, err := parseStaticHeaders([]string{"X-Api-Key=secret", "X-Multi=a", "X-Multi=b"})
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	if got := headers.Get("X-Api-Key"); got != "secret" {
+		t.Errorf("expected X-Api-Key %q, got %q", "secret", got)
+	}
+	if got := headers["X-Multi"]; len(got) != 2 {
+		t.Errorf("expected the repeated header to keep both values, got %v", got)
+	}
+
+	for _, invalid := range []string{"no-separator", "=value"} {
+		if _, err := parseStaticHeaders([]string{invalid}); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestSetStaticHeadersDropsClientCopies(t *testing.T) {
+	static, err := parseStaticHeaders([]string{"X-Api-Key=proxy-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/resource", nil)
+	req.Header.Set("X-Api-Key", "client-forged")
+	req.Header.Set("X-Other", "kept")
+	setStaticHeaders(req.Header, static)
+
+	if got := req.Header["X-Api-Key"]; len(got) != 1 || got[0] != "proxy-secret" {
+		t.Errorf("expected the client-supplied copy to be replaced, got %v", got)
+	}
+	if got := req.Header.Get("X-Other"); got != "kept" {
+		t.Errorf("expected unrelated headers to be untouched, got %q", got)
+	}
+}
+
+func TestIsCORSPreflight(t *testing.T) {
+	preflight := httptest.NewRequest(http.MethodOptions, "/resource", nil)
+	preflight.Header.Set("Origin", "https://app.example.com")
+	preflight.Header.Set("Access-Control-Request-Method", "GET")
+	if !isCORSPreflight(preflight) {
+		t.Error("expected an OPTIONS request with Origin and Access-Control-Request-Method to be a preflight")
+	}
+
+	bareOptions := httptest.NewRequest(http.MethodOptions, "/resource", nil)
+	if isCORSPreflight(bareOptions) {
+		t.Error("expected a bare OPTIONS request not to be a preflight")
+	}
+
+	get := httptest.NewRequest(http.MethodGet, "/resource", nil)
+	get.Header.Set("Origin", "https://app.example.com")
+	get.Header.Set("Access-Control-Request-Method", "GET")
+	if isCORSPreflight(get) {
+		t.Error("expected a non-OPTIONS request not to be a preflight")
+	}
+}
+
+func TestLifetimeBoundedTransportCapsIdleConnections(t *testing.T) {
+	transport := lifetimeBoundedTransport(time.Hour)
+	if transport.IdleConnTimeout != time.Hour {
+		t.Errorf("expected the idle connection timeout to match the lifetime, got %v", transport.IdleConnTimeout)
+	}
+}
+
+func TestAmbiguousFraming(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		mutate func(req *http.Request)
+		want   bool
+	}{
+		{name: "plain request", mutate: func(req *http.Request) {}, want: false},
+		{name: "content length only", mutate: func(req *http.Request) {
+			req.Header.Set("Content-Length", "12")
+		}, want: false},
+		{name: "transfer encoding and content length", mutate: func(req *http.Request) {
+			req.TransferEncoding = []string{"chunked"}
+			req.Header.Set("Content-Length", "12")
+		}, want: true},
+		{name: "conflicting content lengths", mutate: func(req *http.Request) {
+			req.Header["Content-Length"] = []string{"12", "34"}
+		}, want: true},
+		{name: "repeated identical content lengths", mutate: func(req *http.Request) {
+			req.Header["Content-Length"] = []string{"12", "12"}
+		}, want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/resource", nil)
+			tc.mutate(req)
+			if got := ambiguousFraming(req); got != tc.want {
+				t.Errorf("ambiguousFraming = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConfigureHTTP2Disabled(t *testing.T) {
+	srv := &http.Server{TLSConfig: &tls.Config{NextProtos: []string{"h2"}}}
+	if err := configureHTTP2(srv, true, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := srv.TLSConfig.NextProtos; len(got) != 1 || got[0] != "http/1.1" {
+		t.Errorf("expected only http/1.1 to be advertised, got %v", got)
+	}
+}
+
+func TestConfigureHTTP2CapsConcurrentStreams(t *testing.T) {
+	srv := &http.Server{TLSConfig: &tls.Config{NextProtos: []string{"h2"}}}
+	if err := configureHTTP2(srv, false, 128); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	found := false
+	for _, proto := range srv.TLSConfig.NextProtos {
+		if proto == "h2" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected h2 to stay advertised with a stream cap, got %v", srv.TLSConfig.NextProtos)
+	}
+}
+
+func TestParseCertFingerprint(t *testing.T) {
+	sum := sha256.Sum256([]byte("leaf"))
+	plain := hex.EncodeToString(sum[:])
+
+	var colonized []string
+	for i := 0; i < len(plain); i += 2 {
+		colonized = append(colonized, strings.ToUpper(plain[i:i+2]))
+	}
+
+	for _, valid := range []string{plain, strings.Join(colonized, ":")} {
+		fingerprint, err := parseCertFingerprint(valid)
+		if err != nil {
+			t.Fatalf("unexpected parse error for %q: %v", valid, err)
+		}
+		if !bytes.Equal(fingerprint, sum[:]) {
+			t.Errorf("expected %q to parse to the raw digest", valid)
+		}
+	}
+
+	for _, invalid := range []string{"zz", plain[:10], ""} {
+		if _, err := parseCertFingerprint(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestPinVerifier(t *testing.T) {
+	pinned := []byte("pinned certificate")
+	sum := sha256.Sum256(pinned)
+	verify := pinVerifier(sum[:])
+
+	if err := verify([][]byte{pinned}, nil); err != nil {
+		t.Errorf("expected the pinned certificate to verify, got %v", err)
+	}
+	if err := verify([][]byte{[]byte("some other certificate")}, nil); err == nil {
+		t.Error("expected a different certificate to be rejected")
+	}
+	if err := verify(nil, nil); err == nil {
+		t.Error("expected a missing certificate to be rejected")
+	}
+}
+
+func TestForbiddenInterceptorSwallows403(t *testing.T) {
+	rec := httptest.NewRecorder()
+	i := &forbiddenInterceptor{w: rec}
+	i.Header().Set("X-Reason", "denied")
+	i.WriteHeader(http.StatusForbidden)
+	i.Write([]byte("Forbidden"))
+
+	if !i.intercepted {
+		t.Error("expected the 403 to be intercepted")
+	}
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("expected nothing to reach the underlying writer, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestForbiddenInterceptorPassesOtherStatusesThrough(t *testing.T) {
+	rec := httptest.NewRecorder()
+	i := &forbiddenInterceptor{w: rec}
+	i.Header().Set("WWW-Authenticate", "Bearer")
+	i.WriteHeader(http.StatusUnauthorized)
+	i.Write([]byte("Unauthorized"))
+
+	if i.intercepted {
+		t.Error("expected a non-403 response not to be intercepted")
+	}
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+	if got := rec.Header().Get("WWW-Authenticate"); got != "Bearer" {
+		t.Errorf("expected buffered headers to be forwarded, got %q", got)
+	}
+	if rec.Body.String() != "Unauthorized" {
+		t.Errorf("expected the body to pass through, got %q", rec.Body.String())
+	}
+}
+
+func TestRejectMissingHost(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/resource", nil)
+	req.Host = ""
+	rec := httptest.NewRecorder()
+	if !rejectMissingHost(rec, req) {
+		t.Error("expected a request without a Host to be rejected")
+	}
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	if rejectMissingHost(rec, httptest.NewRequest(http.MethodGet, "http://example.com/resource", nil)) {
+		t.Error("expected a request with a Host to pass through")
+	}
+}
+
+func TestIsUpgradeRequest(t *testing.T) {
+	upgrade := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	upgrade.Header.Set("Connection", "keep-alive, Upgrade")
+	upgrade.Header.Set("Upgrade", "websocket")
+	if !isUpgradeRequest(upgrade) {
+		t.Error("expected a Connection: Upgrade request to be detected")
+	}
+
+	plain := httptest.NewRequest(http.MethodGet, "/resource", nil)
+	plain.Header.Set("Connection", "keep-alive")
+	if isUpgradeRequest(plain) {
+		t.Error("expected a plain request not to be detected as an upgrade")
+	}
+}
+
+func TestBindToTokenExpiry(t *testing.T) {
+	// Without a token expiry on the context the request passes unchanged.
+	req := httptest.NewRequest(http.MethodGet, "/stream", nil)
+	bounded, cancel, ok := bindToTokenExpiry(httptest.NewRecorder(), req)
+	if !ok || bounded != req {
+		t.Error("expected a request without a token expiry to pass through unchanged")
+	}
+	cancel()
+
+	// A token already past its expiry never starts a long-lived connection.
+	req = httptest.NewRequest(http.MethodGet, "/stream", nil)
+	req = req.WithContext(auth.WithTokenExpiry(req.Context(), time.Now().Add(-time.Minute)))
+	rec := httptest.NewRecorder()
+	if _, _, ok := bindToTokenExpiry(rec, req); ok {
+		t.Error("expected an expired token to be rejected")
+	}
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
+
+func TestStreamTerminatesWhenTokenExpiryPasses(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/stream", nil)
+	req = req.WithContext(auth.WithTokenExpiry(req.Context(), time.Now().Add(50*time.Millisecond)))
+
+	bounded, cancel, ok := bindToTokenExpiry(httptest.NewRecorder(), req)
+	if !ok {
+		t.Fatal("expected a not-yet-expired token to be admitted")
+	}
+	defer cancel()
+
+	// The bounded context stands in for the proxied stream: it must be torn
+	// down once the token's expiry passes.
+	select {
+	case <-bounded.Context().Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the stream's context to expire with the token")
+	}
+}
+
+func TestStatusRecordingWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	lw := &statusRecordingWriter{w: rec}
+	lw.WriteHeader(http.StatusBadGateway)
+	lw.WriteHeader(http.StatusOK)
+	lw.Write([]byte("Bad Gateway"))
+
+	if lw.status != http.StatusBadGateway {
+		t.Errorf("expected the first status to be recorded, got %d", lw.status)
+	}
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected the status to pass through, got %d", rec.Code)
+	}
+	if rec.Body.String() != "Bad Gateway" {
+		t.Errorf("expected the body to pass through, got %q", rec.Body.String())
+	}
+
+	// An implicit 200 through Write alone.
+	rec = httptest.NewRecorder()
+	lw = &statusRecordingWriter{w: rec}
+	lw.Write([]byte("ok"))
+	if lw.status != http.StatusOK {
+		t.Errorf("expected an implicit 200 to be recorded, got %d", lw.status)
+	}
+}
+
+func TestResponseLogHandlerPreservesResponses(t *testing.T) {
+	h := &responseLogHandler{
+		handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+			w.Write([]byte("short and stout"))
+		}),
+		levels: map[string]glog.Level{"4xx": 0},
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/teapot", nil))
+	if rec.Code != http.StatusTeapot || rec.Body.String() != "short and stout" {
+		t.Errorf("expected the response to pass through unchanged, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestContentTypeAllowed(t *testing.T) {
+	allowed := []string{"application/json", "application/yaml"}
+	for _, tc := range []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"Application/JSON", true},
+		{"text/plain", false},
+		{"", false},
+	} {
+		if got := contentTypeAllowed(tc.contentType, allowed); got != tc.want {
+			t.Errorf("contentTypeAllowed(%q) = %v, want %v", tc.contentType, got, tc.want)
+		}
+	}
+}
+
+func TestPathMatchesAny(t *testing.T) {
+	patterns := []string{"/metrics", "/debug/*"}
+	for _, tc := range []struct {
+		path string
+		want bool
+	}{
+		{"/metrics", true},
+		{"/metrics/sub", false},
+		{"/debug/pprof", true},
+		{"/debug", false},
+		{"/debug/../metrics", true},
+		{"/other", false},
+	} {
+		if got := pathMatchesAny(tc.path, patterns); got != tc.want {
+			t.Errorf("pathMatchesAny(%q) = %v, want %v", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	for _, tc := range []struct {
+		accept string
+		want   bool
+	}{
+		{accept: "application/json", want: true},
+		{accept: "text/html, application/json;q=0.9", want: true},
+		{accept: "text/plain", want: false},
+		{accept: "", want: false},
+		{accept: "application/json-patch+json", want: false},
+	} {
+		if got := acceptsJSON(tc.accept); got != tc.want {
+			t.Errorf("acceptsJSON(%q) = %v, want %v", tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestGatewayErrorHandler(t *testing.T) {
+	handler := gatewayErrorHandler(false)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api", nil), errors.New("connection refused"))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected status %d for a failed round-trip, got %d", http.StatusBadGateway, rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "connection refused") {
+		t.Error("expected the underlying error not to leak to the client")
+	}
+
+	// A request that ran into its deadline maps to a 504 instead.
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api", nil).WithContext(ctx), errors.New("context deadline exceeded"))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected status %d for a timed-out round-trip, got %d", http.StatusGatewayTimeout, rec.Code)
+	}
+}
+
+func TestGatewayErrorHandlerJSONNegotiation(t *testing.T) {
+	handler := gatewayErrorHandler(true)
+
+	req := httptest.NewRequest(http.MethodGet, "/api", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	handler(rec, req, errors.New("upstream gone"))
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Fatalf("expected a JSON error body, got Content-Type %q", got)
+	}
+	var body struct {
+		Error  string `json:"error"`
+		Status int    `json:"status"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unexpected error decoding the body: %v", err)
+	}
+	if body.Status != http.StatusBadGateway || body.Error != http.StatusText(http.StatusBadGateway) {
+		t.Errorf("unexpected JSON error body: %+v", body)
+	}
+
+	// Clients that do not ask for JSON keep getting plain text.
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api", nil), errors.New("upstream gone"))
+	if got := rec.Header().Get("Content-Type"); got == "application/json" {
+		t.Error("expected a plain text error without an Accept: application/json header")
+	}
+}
+
+// metricValue scrapes the metrics handler and returns the current value of
+// the named sample, or zero if it has not been written yet.
+func metricValue(t *testing.T, name string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			v, err := strconv.ParseFloat(strings.TrimPrefix(line, name+" "), 64)
+			if err != nil {
+				t.Fatalf("unexpected sample line %q: %v", line, err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+type erroringBody struct{ err error }
+
+func (b erroringBody) Read(p []byte) (int, error) { return 0, b.err }
+func (erroringBody) Close() error                 { return nil }
+
+func TestTruncationDetectingBodyCountsMidResponseFailures(t *testing.T) {
+	const counter = "kube_rbac_proxy_upstream_truncated_responses_total"
+	before := metricValue(t, counter)
+
+	body := &truncationDetectingBody{ReadCloser: erroringBody{err: errors.New("connection reset by peer")}, path: "/api"}
+	if _, err := body.Read(make([]byte, 16)); err == nil {
+		t.Fatal("expected the read error to be passed through")
+	}
+	if got := metricValue(t, counter); got != before+1 {
+		t.Errorf("expected the truncation counter to go from %v to %v, got %v", before, before+1, got)
+	}
+
+	// A clean end of body is not a truncation.
+	body = &truncationDetectingBody{ReadCloser: erroringBody{err: io.EOF}, path: "/api"}
+	body.Read(make([]byte, 16))
+	if got := metricValue(t, counter); got != before+1 {
+		t.Errorf("expected EOF not to count as truncation, counter moved to %v", got)
+	}
+}
+
+func TestTruncationDetectingBodySkipsContextErrors(t *testing.T) {
+	const counter = "kube_rbac_proxy_upstream_truncated_responses_total"
+	before := metricValue(t, counter)
+
+	// The client going away or the request deadline firing surfaces as a
+	// context error on the body read; neither is an upstream failure.
+	for _, cause := range []error{context.Canceled, context.DeadlineExceeded} {
+		body := &truncationDetectingBody{ReadCloser: erroringBody{err: fmt.Errorf("read aborted: %w", cause)}, path: "/api"}
+		if _, err := body.Read(make([]byte, 16)); !errors.Is(err, cause) {
+			t.Fatalf("expected the %v error to be passed through, got %v", cause, err)
+		}
+	}
+	if got := metricValue(t, counter); got != before {
+		t.Errorf("expected context errors not to count as truncation, counter moved from %v to %v", before, got)
+	}
+}
+
+func TestAnswerCORSPreflight(t *testing.T) {
+	cors := &auth.CORSConfig{
+		AllowedOrigins: []string{"https://ui.example.com"},
+		AllowedMethods: []string{"GET", "POST"},
+		AllowedHeaders: []string{"Authorization"},
+	}
+
+	req := httptest.NewRequest(http.MethodOptions, "/api", nil)
+	req.Header.Set("Origin", "https://ui.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rec := httptest.NewRecorder()
+	if !answerCORSPreflight(rec, req, cors) {
+		t.Fatal("expected the preflight from an allowed origin to be answered")
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://ui.example.com" {
+		t.Errorf("unexpected Access-Control-Allow-Origin %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "GET, POST" {
+		t.Errorf("unexpected Access-Control-Allow-Methods %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Headers"); got != "Authorization" {
+		t.Errorf("unexpected Access-Control-Allow-Headers %q", got)
+	}
+	if got := rec.Header().Get("Vary"); got != "Origin" {
+		t.Errorf("expected a Vary: Origin header, got %q", got)
+	}
+
+	// Other origins fall through to regular handling.
+	req.Header.Set("Origin", "https://evil.example.com")
+	if answerCORSPreflight(httptest.NewRecorder(), req, cors) {
+		t.Error("expected the preflight from an unlisted origin not to be answered")
+	}
+	// Without CORS configuration nothing is answered.
+	if answerCORSPreflight(httptest.NewRecorder(), req, nil) {
+		t.Error("expected no answer without CORS configuration")
+	}
+}
+
+func TestCORSOriginAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		origins []string
+		origin  string
+		want    bool
+	}{
+		{name: "listed origin", origins: []string{"https://ui.example.com"}, origin: "https://ui.example.com", want: true},
+		{name: "unlisted origin", origins: []string{"https://ui.example.com"}, origin: "https://other.example.com", want: false},
+		{name: "wildcard", origins: []string{"*"}, origin: "https://anything.example.com", want: true},
+		{name: "empty origin never matches", origins: []string{"*"}, origin: "", want: false},
+		{name: "no origins configured", origins: nil, origin: "https://ui.example.com", want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cors := &auth.CORSConfig{AllowedOrigins: tc.origins}
+			if got := cors.OriginAllowed(tc.origin); got != tc.want {
+				t.Errorf("OriginAllowed(%q) = %v, want %v", tc.origin, got, tc.want)
+			}
+		})
+	}
+}
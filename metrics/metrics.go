@@ -0,0 +1,263 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics exposes kube-rbac-proxy's own operational metrics in
+// Prometheus format. It keeps its own registry so that metrics of the proxied
+// upstream are never mixed with the proxy's.
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	upstreamResponses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kube_rbac_proxy_upstream_responses_total",
+			Help: "Count of responses received from the upstream, by status code and status code class.",
+		},
+		[]string{"code_class", "code"},
+	)
+
+	deprecatedConfigFields = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kube_rbac_proxy_deprecated_config_field_in_use",
+			Help: "Set to 1 for every deprecated configuration field the proxy was started with, so operators can migrate before removal.",
+		},
+		[]string{"field"},
+	)
+
+	authorizationDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kube_rbac_proxy_authorization_decisions_total",
+			Help: "Count of authorization decisions, by HTTP method, derived RBAC verb and decision.",
+		},
+		[]string{"method", "verb", "decision"},
+	)
+
+	forcedRevalidations = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kube_rbac_proxy_forced_token_revalidations_total",
+			Help: "Count of authentications that bypassed the cache because the presented token's expiry had passed before its cache entry's TTL.",
+		},
+	)
+
+	truncatedUpstreamResponses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kube_rbac_proxy_upstream_truncated_responses_total",
+			Help: "Count of upstream responses that ended with a connection failure mid-body instead of a clean end of response.",
+		},
+	)
+
+	tenantDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kube_rbac_proxy_tenant_authorization_decisions_total",
+			Help: "Count of authorization outcomes per tenant value captured by the configured rewrites. Tenants outside the label allowlist are collapsed to \"other\".",
+		},
+		[]string{"tenant", "decision"},
+	)
+)
+
+func init() {
+	registry.MustRegister(upstreamResponses)
+	registry.MustRegister(deprecatedConfigFields)
+	registry.MustRegister(authorizationDecisions)
+	registry.MustRegister(forcedRevalidations)
+	registry.MustRegister(truncatedUpstreamResponses)
+	registry.MustRegister(tenantDecisions)
+}
+
+// RecordForcedRevalidation counts an authentication that was forced past the
+// cache because the presented token had already expired.
+func RecordForcedRevalidation() {
+	forcedRevalidations.Inc()
+}
+
+// RecordUpstreamTruncation counts an upstream response that failed mid-body,
+// i.e. was cut short by a connection error rather than ending cleanly.
+func RecordUpstreamTruncation() {
+	truncatedUpstreamResponses.Inc()
+}
+
+// RecordTenantDecision counts an authorization outcome for a tenant value
+// captured out of the request by the configured rewrites. The tenant value is
+// request-derived and must pass through the label allowlist.
+func RecordTenantDecision(tenant, decision string) {
+	tenantDecisions.WithLabelValues(boundedLabel(tenant), decision).Inc()
+}
+
+// RecordDeprecatedField marks a deprecated configuration field as in use. The
+// field label is a fixed configuration field name, so the label space is
+// bounded by the configuration surface.
+func RecordDeprecatedField(field string) {
+	deprecatedConfigFields.WithLabelValues(field).Set(1)
+}
+
+var (
+	labelAllowlistMu sync.RWMutex
+	labelAllowlist   map[string]struct{}
+)
+
+// SetLabelAllowlist installs the set of values that may appear verbatim in
+// metric labels carrying request-derived data (verbs, resources, namespaces,
+// tenants). Everything else is collapsed to "other", so attacker-controlled
+// request values cannot explode metric cardinality. A nil or empty allowlist
+// leaves values untouched.
+func SetLabelAllowlist(values []string) {
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+
+	labelAllowlistMu.Lock()
+	defer labelAllowlistMu.Unlock()
+	if len(set) == 0 {
+		labelAllowlist = nil
+		return
+	}
+	labelAllowlist = set
+}
+
+// boundedLabel returns the label value itself when it is allowlisted (or no
+// allowlist is configured), and "other" otherwise. Every metric emitter with
+// a request-derived label value routes it through here.
+func boundedLabel(value string) string {
+	labelAllowlistMu.RLock()
+	defer labelAllowlistMu.RUnlock()
+	if labelAllowlist == nil {
+		return value
+	}
+	if _, ok := labelAllowlist[value]; ok {
+		return value
+	}
+	return "other"
+}
+
+// knownMethods bounds the method label; anything else (clients can send
+// arbitrary method strings) is collapsed to "other".
+var knownMethods = map[string]struct{}{
+	"GET": {}, "HEAD": {}, "POST": {}, "PUT": {}, "PATCH": {}, "DELETE": {}, "OPTIONS": {},
+}
+
+// RecordAuthorizationDecision counts an authorization decision. The HTTP
+// method and the derived RBAC verb are recorded separately so that operators
+// can correlate the HTTP-level and RBAC-level views when the method-to-verb
+// mapping is customized.
+func RecordAuthorizationDecision(method, verb, decision string) {
+	if _, ok := knownMethods[method]; !ok {
+		method = "other"
+	}
+	authorizationDecisions.WithLabelValues(method, boundedLabel(verb), decision).Inc()
+}
+
+// RecordUpstreamResponse counts an upstream response. The status code label
+// is naturally bounded by the HTTP status code space; the class label allows
+// cheap aggregation over 2xx/3xx/4xx/5xx.
+func RecordUpstreamResponse(statusCode int) {
+	class := "unknown"
+	switch {
+	case statusCode >= 200 && statusCode < 300:
+		class = "2xx"
+	case statusCode >= 300 && statusCode < 400:
+		class = "3xx"
+	case statusCode >= 400 && statusCode < 500:
+		class = "4xx"
+	case statusCode >= 500 && statusCode < 600:
+		class = "5xx"
+	}
+
+	upstreamResponses.WithLabelValues(class, strconv.Itoa(statusCode)).Inc()
+}
+
+const openMetricsContentType = "application/openmetrics-text; version=0.0.1; charset=utf-8"
+
+// Handler serves the proxy's own metrics. Scrapers that request
+// application/openmetrics-text via the Accept header get an OpenMetrics-style
+// exposition; everything else gets the Prometheus text format.
+func Handler() http.Handler {
+	promHandler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsOpenMetrics(r.Header.Get("Accept")) {
+			promHandler.ServeHTTP(w, r)
+			return
+		}
+
+		// The vendored exposition library has no native OpenMetrics encoder.
+		// For the counter and gauge metrics the proxy exposes, the Prometheus
+		// text format only differs from OpenMetrics in the metadata lines of
+		// counters — the family name must not carry the samples' _total
+		// suffix — and in the mandatory EOF marker; both are fixed up here.
+		mfs, err := registry.Gather()
+		if err != nil {
+			http.Error(w, "An error has occurred during metrics gathering", http.StatusInternalServerError)
+			return
+		}
+
+		var buf bytes.Buffer
+		for _, mf := range mfs {
+			var fam bytes.Buffer
+			if err := expfmt.NewEncoder(&fam, expfmt.FmtText).Encode(mf); err != nil {
+				http.Error(w, "An error has occurred during metrics encoding", http.StatusInternalServerError)
+				return
+			}
+			buf.Write(openMetricsMetadata(mf, fam.Bytes()))
+		}
+		buf.WriteString("# EOF\n")
+
+		w.Header().Set("Content-Type", openMetricsContentType)
+		w.Write(buf.Bytes())
+	})
+}
+
+// openMetricsMetadata turns the Prometheus text exposition of one metric
+// family into its OpenMetrics equivalent. For a counter, OpenMetrics names
+// the family without the _total suffix its samples carry, so the HELP and
+// TYPE lines are rewritten; sample lines and other metric types pass through
+// unchanged.
+func openMetricsMetadata(mf *dto.MetricFamily, text []byte) []byte {
+	name := mf.GetName()
+	if mf.GetType() != dto.MetricType_COUNTER || !strings.HasSuffix(name, "_total") {
+		return text
+	}
+	family := strings.TrimSuffix(name, "_total")
+	text = bytes.Replace(text, []byte("# HELP "+name+" "), []byte("# HELP "+family+" "), 1)
+	text = bytes.Replace(text, []byte("# TYPE "+name+" counter"), []byte("# TYPE "+family+" counter"), 1)
+	return text
+}
+
+// acceptsOpenMetrics reports whether an Accept header asks for the
+// OpenMetrics exposition format.
+func acceptsOpenMetrics(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		if mediaType == "application/openmetrics-text" {
+			return true
+		}
+	}
+	return false
+}
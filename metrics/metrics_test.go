@@ -0,0 +1,135 @@
+/*
+Copyright 2017 Frederic Branczyk Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// scrape serves the metrics endpoint and returns the exposition body.
+func scrape(t *testing.T, accept string) (string, http.Header) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected a 200 from the metrics endpoint, got %d", rec.Code)
+	}
+	return rec.Body.String(), rec.Header()
+}
+
+func TestRecordUpstreamResponseCountsByCodeAndClass(t *testing.T) {
+	RecordUpstreamResponse(502)
+	RecordUpstreamResponse(502)
+
+	body, _ := scrape(t, "")
+	want := `kube_rbac_proxy_upstream_responses_total{code="502",code_class="5xx"} 2`
+	if !strings.Contains(body, want) {
+		t.Errorf("expected the exposition to contain %q, got:\n%s", want, body)
+	}
+}
+
+func TestRecordAuthorizationDecisionBoundsTheMethodLabel(t *testing.T) {
+	RecordAuthorizationDecision("GET", "get", "allow-490")
+	RecordAuthorizationDecision("PROPFIND", "get", "allow-490")
+
+	body, _ := scrape(t, "")
+	known := `kube_rbac_proxy_authorization_decisions_total{decision="allow-490",method="GET",verb="get"} 1`
+	if !strings.Contains(body, known) {
+		t.Errorf("expected the exposition to contain %q, got:\n%s", known, body)
+	}
+	collapsed := `kube_rbac_proxy_authorization_decisions_total{decision="allow-490",method="other",verb="get"} 1`
+	if !strings.Contains(body, collapsed) {
+		t.Errorf("expected unknown methods to collapse to %q, got:\n%s", collapsed, body)
+	}
+}
+
+func TestRecordDeprecatedField(t *testing.T) {
+	RecordDeprecatedField("resource-attributes-file-495")
+
+	body, _ := scrape(t, "")
+	want := `kube_rbac_proxy_deprecated_config_field_in_use{field="resource-attributes-file-495"} 1`
+	if !strings.Contains(body, want) {
+		t.Errorf("expected the exposition to contain %q, got:\n%s", want, body)
+	}
+}
+
+func TestHandlerNegotiatesOpenMetrics(t *testing.T) {
+	RecordUpstreamResponse(496)
+
+	body, header := scrape(t, "application/openmetrics-text; version=0.0.1,text/plain;q=0.5")
+	if ct := header.Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Fatalf("expected an OpenMetrics content type, got %q", ct)
+	}
+	if !strings.HasSuffix(strings.TrimRight(body, "\n"), "# EOF") {
+		t.Error("expected the OpenMetrics exposition to end with # EOF")
+	}
+	// OpenMetrics counter metadata names the family without the _total
+	// suffix; the suffix only appears on the samples.
+	if strings.Contains(body, "# TYPE kube_rbac_proxy_upstream_responses_total counter") {
+		t.Error("expected counter TYPE metadata without the _total suffix")
+	}
+	if !strings.Contains(body, "# TYPE kube_rbac_proxy_upstream_responses counter") {
+		t.Errorf("expected the rewritten counter family metadata, got:\n%s", body)
+	}
+	if !strings.Contains(body, `kube_rbac_proxy_upstream_responses_total{code="496",code_class="4xx"}`) {
+		t.Errorf("expected the counter sample to keep the _total suffix, got:\n%s", body)
+	}
+}
+
+func TestHandlerServesPrometheusTextByDefault(t *testing.T) {
+	_, header := scrape(t, "text/plain")
+	if ct := header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expected the plain text exposition format, got %q", ct)
+	}
+}
+
+func TestLabelAllowlistBoundsVerbCardinality(t *testing.T) {
+	SetLabelAllowlist([]string{"get", "list"})
+	defer SetLabelAllowlist(nil)
+
+	RecordAuthorizationDecision("GET", "get", "allow-504")
+	RecordAuthorizationDecision("GET", "unexpected-verb", "allow-504")
+
+	body, _ := scrape(t, "")
+	if !strings.Contains(body, `method="GET",verb="get"} 1`) {
+		t.Errorf("expected the allowlisted verb to be recorded as-is, got:\n%s", body)
+	}
+	if !strings.Contains(body, `kube_rbac_proxy_authorization_decisions_total{decision="allow-504",method="GET",verb="other"} 1`) {
+		t.Errorf("expected the unexpected verb to collapse to other, got:\n%s", body)
+	}
+}
+
+func TestRecordForcedRevalidation(t *testing.T) {
+	body, _ := scrape(t, "")
+	if !strings.Contains(body, "kube_rbac_proxy_forced_token_revalidations_total") {
+		t.Fatalf("expected the forced revalidation counter to be registered, got:\n%s", body)
+	}
+
+	RecordForcedRevalidation()
+	RecordForcedRevalidation()
+	body, _ = scrape(t, "")
+	if !strings.Contains(body, "kube_rbac_proxy_forced_token_revalidations_total 2") {
+		t.Errorf("expected two forced revalidations to be counted, got:\n%s", body)
+	}
+}